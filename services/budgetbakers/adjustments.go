@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+)
+
+//go:embed migrations/0013_balance_adjustments.sql
+var adjustmentsMigrationSQL string
+
+func init() {
+	registerSQLMigration(13, "balance_adjustments", adjustmentsMigrationSQL)
+}
+
+type adjustBalanceRequest struct {
+	BalanceCents int64   `json:"balanceCents"`
+	Note         string  `json:"note"`
+	OccurredAt   *string `json:"occurredAt"`
+}
+
+func (req adjustBalanceRequest) recordedAt() (time.Time, error) {
+	if req.OccurredAt == nil || *req.OccurredAt == "" {
+		return time.Now().UTC(), nil
+	}
+	return time.Parse(time.RFC3339, *req.OccurredAt)
+}
+
+// handleAdjustBalance lets a user record a manual balance correction — a cash
+// transaction or a mis-synced balance they don't want to wait for the next
+// CouchDB pull to fix. It inserts a balance_history row tagged source='manual'
+// rather than touching any synced data, so it's layered on top of the ledger
+// the same way a sync snapshot is (see refreshAccountSnapshot).
+func (s *server) handleAdjustBalance(w http.ResponseWriter, r *http.Request) {
+	idParam := chi.URLParam(r, "id")
+	id, err := strconv.ParseInt(idParam, 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid account id")
+		return
+	}
+
+	acc, err := s.db.GetAccountByIDForUser(r.Context(), id, userFromContext(r.Context()).ID)
+	if err != nil {
+		log.Printf("Failed to get account: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to get account")
+		return
+	}
+	if acc == nil {
+		writeError(w, http.StatusNotFound, "account not found")
+		return
+	}
+
+	var req adjustBalanceRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Note == "" {
+		writeError(w, http.StatusBadRequest, "note is required")
+		return
+	}
+	recordedAt, err := req.recordedAt()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid occurredAt")
+		return
+	}
+
+	point, err := s.db.InsertManualAdjustment(r.Context(), id, req.BalanceCents, req.Note, recordedAt)
+	if err != nil {
+		log.Printf("Failed to insert balance adjustment for account %d: %v", id, err)
+		writeError(w, http.StatusInternalServerError, "failed to save adjustment")
+		return
+	}
+
+	if err := s.db.UpdateAccountBalance(r.Context(), id, req.BalanceCents); err != nil {
+		log.Printf("Failed to update balance for account %d: %v", id, err)
+	}
+
+	writeJSON(w, http.StatusOK, point)
+}
+
+// handleListAdjustments returns an account's manual balance-history entries,
+// including superseded ones, so the UI can render the full edit trail rather
+// than just the current value.
+func (s *server) handleListAdjustments(w http.ResponseWriter, r *http.Request) {
+	idParam := chi.URLParam(r, "id")
+	id, err := strconv.ParseInt(idParam, 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid account id")
+		return
+	}
+
+	acc, err := s.db.GetAccountByIDForUser(r.Context(), id, userFromContext(r.Context()).ID)
+	if err != nil {
+		log.Printf("Failed to get account: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to get account")
+		return
+	}
+	if acc == nil {
+		writeError(w, http.StatusNotFound, "account not found")
+		return
+	}
+
+	adjustments, err := s.db.ListManualAdjustments(r.Context(), id)
+	if err != nil {
+		log.Printf("Failed to list adjustments for account %d: %v", id, err)
+		writeError(w, http.StatusInternalServerError, "failed to list adjustments")
+		return
+	}
+	if adjustments == nil {
+		adjustments = []BalanceHistoryPoint{}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"accountId":   id,
+		"adjustments": adjustments,
+	})
+}
+
+type patchAdjustmentRequest struct {
+	BalanceCents int64   `json:"balanceCents"`
+	Note         string  `json:"note"`
+	OccurredAt   *string `json:"occurredAt"`
+}
+
+func (req patchAdjustmentRequest) recordedAt() (time.Time, error) {
+	if req.OccurredAt == nil || *req.OccurredAt == "" {
+		return time.Now().UTC(), nil
+	}
+	return time.Parse(time.RFC3339, *req.OccurredAt)
+}
+
+// handlePatchAdjustment supersedes an earlier manual adjustment rather than
+// editing it in place: the old balance_history row is kept with
+// superseded_by set to the new one's id, so the edit trail stays auditable.
+func (s *server) handlePatchAdjustment(w http.ResponseWriter, r *http.Request) {
+	idParam := chi.URLParam(r, "id")
+	id, err := strconv.ParseInt(idParam, 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid adjustment id")
+		return
+	}
+
+	var req patchAdjustmentRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Note == "" {
+		writeError(w, http.StatusBadRequest, "note is required")
+		return
+	}
+	recordedAt, err := req.recordedAt()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid occurredAt")
+		return
+	}
+
+	point, err := s.db.SupersedeAdjustment(r.Context(), id, userFromContext(r.Context()).ID, req.BalanceCents, req.Note, recordedAt)
+	if err != nil {
+		if errors.Is(err, errAdjustmentNotFound) {
+			writeError(w, http.StatusNotFound, "adjustment not found")
+			return
+		}
+		log.Printf("Failed to supersede adjustment %d: %v", id, err)
+		writeError(w, http.StatusInternalServerError, "failed to update adjustment")
+		return
+	}
+
+	if err := s.db.UpdateAccountBalance(r.Context(), point.accountID, req.BalanceCents); err != nil {
+		log.Printf("Failed to update balance for account %d: %v", point.accountID, err)
+	}
+
+	writeJSON(w, http.StatusOK, point.BalanceHistoryPoint)
+}
+
+var errAdjustmentNotFound = errors.New("adjustment not found")
+
+// InsertManualAdjustment records a user-entered balance correction.
+func (db *DB) InsertManualAdjustment(ctx context.Context, accountID int64, balanceCents int64, note string, recordedAt time.Time) (*BalanceHistoryPoint, error) {
+	id, err := db.InsertBalanceHistory(ctx, accountID, balanceCents, nil, "manual", &note, recordedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &BalanceHistoryPoint{
+		ID:           id,
+		BalanceCents: balanceCents,
+		Source:       "manual",
+		Note:         &note,
+		RecordedAt:   recordedAt,
+	}, nil
+}
+
+// ListManualAdjustments returns every manual balance_history row for an
+// account, newest first, including ones already superseded.
+func (db *DB) ListManualAdjustments(ctx context.Context, accountID int64) ([]BalanceHistoryPoint, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.Pool.Query(ctx, `
+		SELECT id, balance_cents, balance_usd, source, note, superseded_by, recorded_at
+		FROM balance_history
+		WHERE account_id = $1 AND source = 'manual'
+		ORDER BY recorded_at DESC
+	`, accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var points []BalanceHistoryPoint
+	for rows.Next() {
+		var p BalanceHistoryPoint
+		if err := rows.Scan(&p.ID, &p.BalanceCents, &p.BalanceUSD, &p.Source, &p.Note, &p.SupersededBy, &p.RecordedAt); err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
+
+// adjustmentWithAccount pairs a BalanceHistoryPoint with the account it
+// belongs to, since handlePatchAdjustment needs the account id to refresh
+// accounts.balance_cents but the point itself doesn't carry one.
+type adjustmentWithAccount struct {
+	BalanceHistoryPoint
+	accountID int64
+}
+
+// SupersedeAdjustment inserts a new manual balance_history row and marks the
+// old one as superseded by it, scoped to adjustments owned (via the
+// account's credential) by ownerID. Returns errAdjustmentNotFound if id
+// doesn't exist, isn't a manual entry, has already been superseded, or isn't
+// owned by ownerID.
+func (db *DB) SupersedeAdjustment(ctx context.Context, id, ownerID int64, balanceCents int64, note string, recordedAt time.Time) (*adjustmentWithAccount, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	pgTx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer pgTx.Rollback(ctx)
+
+	var accountID int64
+	err = pgTx.QueryRow(ctx, `
+		SELECT bh.account_id
+		FROM balance_history bh
+		JOIN accounts a ON a.id = bh.account_id
+		JOIN credentials c ON c.id = a.credential_id
+		WHERE bh.id = $1 AND bh.source = 'manual' AND bh.superseded_by IS NULL AND c.owner_id = $2
+	`, id, ownerID).Scan(&accountID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errAdjustmentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var newID int64
+	if err := pgTx.QueryRow(ctx, `
+		INSERT INTO balance_history (account_id, balance_cents, balance_usd, source, note, recorded_at)
+		VALUES ($1, $2, NULL, 'manual', $3, $4)
+		RETURNING id
+	`, accountID, balanceCents, note, recordedAt).Scan(&newID); err != nil {
+		return nil, err
+	}
+
+	if _, err := pgTx.Exec(ctx, `
+		UPDATE balance_history SET superseded_by = $2 WHERE id = $1
+	`, id, newID); err != nil {
+		return nil, err
+	}
+
+	if err := pgTx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	return &adjustmentWithAccount{
+		BalanceHistoryPoint: BalanceHistoryPoint{
+			ID:           newID,
+			BalanceCents: balanceCents,
+			Source:       "manual",
+			Note:         &note,
+			RecordedAt:   recordedAt,
+		},
+		accountID: accountID,
+	}, nil
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	_ "embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+//go:embed migrations/0011_users.sql
+var usersMigrationSQL string
+
+func init() {
+	registerSQLMigration(11, "users", usersMigrationSQL)
+	registerMigration(Migration{
+		Version: 12,
+		Name:    "bootstrap_admin_user",
+		Up:      bootstrapAdminUser,
+		Down: func(ctx context.Context, tx pgx.Tx) error {
+			// The bootstrap user is just a normal users row by this point;
+			// nothing to undo beyond what dropping the table (0011's down)
+			// already does.
+			return nil
+		},
+	})
+}
+
+const (
+	sessionCookieName = "bb_session"
+	sessionTTL        = 30 * 24 * time.Hour
+)
+
+type User struct {
+	ID        int64     `json:"id"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// bootstrapAdminUser creates a single admin user from BOOTSTRAP_ADMIN_EMAIL /
+// BOOTSTRAP_ADMIN_PASSWORD (if set) and assigns every pre-existing
+// credentials row — written back when this service only supported one
+// global account — to that user, so multi-user support doesn't orphan data
+// that was already synced.
+func bootstrapAdminUser(ctx context.Context, tx pgx.Tx) error {
+	email := getEnv("BOOTSTRAP_ADMIN_EMAIL", "")
+	password := getEnv("BOOTSTRAP_ADMIN_PASSWORD", "")
+	if email == "" || password == "" {
+		log.Printf("bootstrap_admin_user: BOOTSTRAP_ADMIN_EMAIL/BOOTSTRAP_ADMIN_PASSWORD not set, skipping")
+		return nil
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("hash bootstrap admin password: %w", err)
+	}
+
+	var adminID int64
+	err = tx.QueryRow(ctx, `
+		INSERT INTO users (email, password_hash)
+		VALUES ($1, $2)
+		ON CONFLICT (email) DO UPDATE SET email = EXCLUDED.email
+		RETURNING id
+	`, email, hash).Scan(&adminID)
+	if err != nil {
+		return fmt.Errorf("create bootstrap admin user: %w", err)
+	}
+
+	if _, err := tx.Exec(ctx, `
+		UPDATE credentials SET owner_id = $1 WHERE owner_id IS NULL
+	`, adminID); err != nil {
+		return fmt.Errorf("assign existing credentials to bootstrap admin: %w", err)
+	}
+
+	return nil
+}
+
+func (db *DB) CreateUser(ctx context.Context, email, password string) (*User, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, fmt.Errorf("hash password: %w", err)
+	}
+
+	var u User
+	err = db.Pool.QueryRow(ctx, `
+		INSERT INTO users (email, password_hash)
+		VALUES ($1, $2)
+		RETURNING id, email, created_at
+	`, email, hash).Scan(&u.ID, &u.Email, &u.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// authenticateUser looks up email and verifies password against the stored
+// bcrypt hash, returning (nil, nil) for either a missing user or a wrong
+// password so callers can give a single "invalid email or password" response
+// without leaking which one was wrong.
+func (db *DB) authenticateUser(ctx context.Context, email, password string) (*User, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	var u User
+	var hash string
+	err := db.Pool.QueryRow(ctx, `
+		SELECT id, email, password_hash, created_at FROM users WHERE email = $1
+	`, email).Scan(&u.ID, &u.Email, &hash, &u.CreatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		return nil, nil
+	}
+	return &u, nil
+}
+
+func (db *DB) CreateSession(ctx context.Context, userID int64) (token string, expiresAt time.Time, err error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	token, err = newSessionToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expiresAt = time.Now().Add(sessionTTL)
+
+	_, err = db.Pool.Exec(ctx, `
+		INSERT INTO sessions (token, user_id, expires_at) VALUES ($1, $2, $3)
+	`, token, userID, expiresAt)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expiresAt, nil
+}
+
+// GetSessionUser resolves a session token to its owning user, or (nil, nil)
+// if the token is missing, unknown, or expired.
+func (db *DB) GetSessionUser(ctx context.Context, token string) (*User, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	var u User
+	err := db.Pool.QueryRow(ctx, `
+		SELECT u.id, u.email, u.created_at
+		FROM sessions s
+		JOIN users u ON u.id = s.user_id
+		WHERE s.token = $1 AND s.expires_at > NOW()
+	`, token).Scan(&u.ID, &u.Email, &u.CreatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (db *DB) DeleteSession(ctx context.Context, token string) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := db.Pool.Exec(ctx, `DELETE FROM sessions WHERE token = $1`, token)
+	return err
+}
+
+func newSessionToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+type userCtxKey struct{}
+
+func contextWithUser(ctx context.Context, u *User) context.Context {
+	return context.WithValue(ctx, userCtxKey{}, u)
+}
+
+// userFromContext returns the authenticated user set by requireAuth. Callers
+// reached through requireAuth can assume this is never nil.
+func userFromContext(ctx context.Context) *User {
+	u, _ := ctx.Value(userCtxKey{}).(*User)
+	return u
+}
+
+// requireAuth rejects any request without a valid session cookie, and
+// otherwise injects the resolved User into the request context for
+// downstream handlers to scope their queries by.
+func (s *server) requireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(sessionCookieName)
+		if err != nil || cookie.Value == "" {
+			writeError(w, http.StatusUnauthorized, "not authenticated")
+			return
+		}
+
+		user, err := s.db.GetSessionUser(r.Context(), cookie.Value)
+		if err != nil {
+			log.Printf("Failed to resolve session: %v", err)
+			writeError(w, http.StatusInternalServerError, "failed to authenticate")
+			return
+		}
+		if user == nil {
+			writeError(w, http.StatusUnauthorized, "not authenticated")
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(contextWithUser(r.Context(), user)))
+	})
+}
+
+type registerRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+func (s *server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	var req registerRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	req.Email = strings.TrimSpace(strings.ToLower(req.Email))
+	if req.Email == "" || len(req.Password) < 8 {
+		writeError(w, http.StatusBadRequest, "email is required and password must be at least 8 characters")
+		return
+	}
+
+	user, err := s.db.CreateUser(r.Context(), req.Email, req.Password)
+	if err != nil {
+		log.Printf("Failed to create user: %v", err)
+		writeError(w, http.StatusConflict, "email is already registered")
+		return
+	}
+
+	s.startSession(w, r, user)
+}
+
+type loginRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+func (s *server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	var req loginRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	user, err := s.db.authenticateUser(r.Context(), strings.TrimSpace(strings.ToLower(req.Email)), req.Password)
+	if err != nil {
+		log.Printf("Failed to authenticate user: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to log in")
+		return
+	}
+	if user == nil {
+		writeError(w, http.StatusUnauthorized, "invalid email or password")
+		return
+	}
+
+	s.startSession(w, r, user)
+}
+
+func (s *server) startSession(w http.ResponseWriter, r *http.Request, user *User) {
+	token, expiresAt, err := s.db.CreateSession(r.Context(), user.ID)
+	if err != nil {
+		log.Printf("Failed to create session: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to log in")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expiresAt,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status": "ok",
+		"email":  user.Email,
+	})
+}
+
+func (s *server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookieName); err == nil && cookie.Value != "" {
+		if err := s.db.DeleteSession(r.Context(), cookie.Value); err != nil {
+			log.Printf("Failed to delete session: %v", err)
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		Expires:  time.Unix(0, 0),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
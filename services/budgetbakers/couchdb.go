@@ -2,14 +2,29 @@ package main
 
 import (
 	"context"
+	_ "embed"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 	"time"
 )
 
+//go:embed migrations/0006_couchdb_sync_state.sql
+var couchdbSyncStateMigrationSQL string
+
+func init() {
+	registerSQLMigration(6, "couchdb_sync_state", couchdbSyncStateMigrationSQL)
+}
+
+// errSequenceInvalidated signals that the CouchDB _changes sequence token we
+// had on file is no longer valid (e.g. the database was compacted), and the
+// caller should wipe it and fall back to a full resync.
+var errSequenceInvalidated = errors.New("couchdb sequence token invalidated")
+
 type CouchDBClient struct {
 	URL      string
 	Database string
@@ -64,6 +79,7 @@ type BBDocument struct {
 	RecordDate        string `json:"recordDate"`
 	CurrencyCode      string `json:"currencyCode"`
 	Type              int    `json:"type"`
+	Category          string `json:"category"`
 }
 
 type BBAccount struct {
@@ -81,6 +97,17 @@ type BBRecord struct {
 	AmountCents int64
 	RecordDate  time.Time
 	Type        int
+	// IsTransfer is true for records that move money between the user's own
+	// tracked accounts (BB category "transfer", or the reserved Type 2).
+	// Transfers are booked into the ledger like any other record, but unlike
+	// external deposits/withdrawals they don't change net contributions.
+	IsTransfer bool
+}
+
+// recordIsTransfer reports whether a BB record represents a move between the
+// user's own accounts rather than money entering or leaving the system.
+func recordIsTransfer(doc BBDocument) bool {
+	return doc.Type == 2 || doc.Category == "transfer"
 }
 
 type BBCurrency struct {
@@ -123,85 +150,206 @@ type BBData struct {
 	Accounts   []BBAccount
 	Records    []BBRecord
 	Currencies map[string]string
-}
 
-func (c *CouchDBClient) FetchBBData(ctx context.Context) (*BBData, error) {
-	allDocs, err := c.FetchAllDocs(ctx)
-	if err != nil {
-		return nil, err
-	}
+	// DeletedRecords holds the CouchDB doc IDs of records an incremental
+	// _changes fetch reported as deleted. A full fetch never populates this
+	// — a deleted doc simply isn't part of _all_docs anymore.
+	DeletedRecords []string
+}
 
-	data := &BBData{
+func newBBData() *BBData {
+	return &BBData{
 		Accounts:   make([]BBAccount, 0),
 		Records:    make([]BBRecord, 0),
 		Currencies: make(map[string]string),
 	}
+}
 
-	for _, row := range allDocs.Rows {
-		var doc BBDocument
-		if err := json.Unmarshal(row.Doc, &doc); err != nil {
-			continue
-		}
+// applyBBDocument folds one BudgetBakers document into data, dispatching on
+// its reservedModelType the same way for both the full _all_docs fetch and
+// the incremental _changes fetch.
+func applyBBDocument(data *BBData, raw json.RawMessage) {
+	var doc BBDocument
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return
+	}
 
-		switch doc.ReservedModelType {
-		case "Currency":
-			var curr struct {
-				ID   string `json:"_id"`
-				Code string `json:"code"`
-			}
-			if err := json.Unmarshal(row.Doc, &curr); err == nil && curr.Code != "" {
-				data.Currencies[curr.ID] = curr.Code
-			}
-
-		case "Account":
-			account := BBAccount{
-				ID:               doc.ID,
-				Name:             doc.Name,
-				CurrencyCode:     doc.CurrencyID,
-				InitAmountCents:  doc.InitAmount,
-				ExcludeFromStats: doc.ExcludeFromStats,
-				Archived:         doc.Archived,
-			}
-			data.Accounts = append(data.Accounts, account)
-
-		case "Record":
-			recordDate, _ := time.Parse(time.RFC3339, doc.RecordDate)
-			record := BBRecord{
-				ID:          doc.ID,
-				AccountID:   doc.AccountID,
-				AmountCents: doc.Amount,
-				RecordDate:  recordDate,
-				Type:        doc.Type,
-			}
-			data.Records = append(data.Records, record)
+	switch doc.ReservedModelType {
+	case "Currency":
+		var curr struct {
+			ID   string `json:"_id"`
+			Code string `json:"code"`
+		}
+		if err := json.Unmarshal(raw, &curr); err == nil && curr.Code != "" {
+			data.Currencies[curr.ID] = curr.Code
 		}
+
+	case "Account":
+		data.Accounts = append(data.Accounts, BBAccount{
+			ID:               doc.ID,
+			Name:             doc.Name,
+			CurrencyCode:     doc.CurrencyID,
+			InitAmountCents:  doc.InitAmount,
+			ExcludeFromStats: doc.ExcludeFromStats,
+			Archived:         doc.Archived,
+		})
+
+	case "Record":
+		recordDate, _ := time.Parse(time.RFC3339, doc.RecordDate)
+		data.Records = append(data.Records, BBRecord{
+			ID:          doc.ID,
+			AccountID:   doc.AccountID,
+			AmountCents: doc.Amount,
+			RecordDate:  recordDate,
+			Type:        doc.Type,
+			IsTransfer:  recordIsTransfer(doc),
+		})
 	}
+}
 
+func resolveCurrencyCodes(data *BBData) {
 	for i := range data.Accounts {
 		if code, ok := data.Currencies[data.Accounts[i].CurrencyCode]; ok {
 			data.Accounts[i].CurrencyCode = code
 		}
 	}
+}
 
-	return data, nil
+// FetchBBData loads BudgetBakers data since the given CouchDB sequence
+// token, returning the new token to persist. An empty `since` does a full
+// _all_docs fetch (the first sync, or a forced resync); a non-empty one
+// polls _changes so steady-state syncs only transfer what changed.
+func (c *CouchDBClient) FetchBBData(ctx context.Context, since string) (*BBData, string, error) {
+	if since == "" {
+		return c.fetchBBDataFull(ctx)
+	}
+	return c.fetchBBDataIncremental(ctx, since)
 }
 
-func (data *BBData) CalculateAccountBalances() map[string]int64 {
-	balances := make(map[string]int64)
+func (c *CouchDBClient) fetchBBDataFull(ctx context.Context) (*BBData, string, error) {
+	allDocs, err := c.FetchAllDocs(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	data := newBBData()
+	for _, row := range allDocs.Rows {
+		applyBBDocument(data, row.Doc)
+	}
+	resolveCurrencyCodes(data)
 
-	for _, acc := range data.Accounts {
-		balances[acc.ID] = acc.InitAmountCents
+	seq, err := c.FetchUpdateSeq(ctx)
+	if err != nil {
+		return nil, "", fmt.Errorf("fetch update_seq: %w", err)
+	}
+
+	return data, seq, nil
+}
+
+func (c *CouchDBClient) fetchBBDataIncremental(ctx context.Context, since string) (*BBData, string, error) {
+	changes, err := c.FetchChanges(ctx, since)
+	if err != nil {
+		return nil, "", err
 	}
 
-	for _, rec := range data.Records {
-		if _, ok := balances[rec.AccountID]; ok {
-			if rec.Type == 0 {
-				balances[rec.AccountID] += rec.AmountCents
-			} else if rec.Type == 1 {
-				balances[rec.AccountID] -= rec.AmountCents
-			}
+	data := newBBData()
+	for _, change := range changes.Results {
+		if change.Deleted {
+			data.DeletedRecords = append(data.DeletedRecords, change.ID)
+			continue
 		}
+		applyBBDocument(data, change.Doc)
+	}
+	resolveCurrencyCodes(data)
+
+	return data, seqToString(changes.LastSeq), nil
+}
+
+type CouchDBChangeEntry struct {
+	ID      string          `json:"id"`
+	Deleted bool            `json:"deleted"`
+	Doc     json.RawMessage `json:"doc"`
+}
+
+type CouchDBChangesResponse struct {
+	LastSeq json.RawMessage      `json:"last_seq"`
+	Results []CouchDBChangeEntry `json:"results"`
+}
+
+func seqToString(raw json.RawMessage) string {
+	return strings.Trim(string(raw), `"`)
+}
+
+// FetchChanges polls CouchDB's _changes feed since the given sequence token.
+// A 400 with reason "badarg" means the token is no longer valid (typically
+// because the database was compacted), which callers should treat as a
+// signal to wipe the token and do a full resync instead.
+func (c *CouchDBClient) FetchChanges(ctx context.Context, since string) (*CouchDBChangesResponse, error) {
+	url := fmt.Sprintf("%s/%s/_changes?since=%s&include_docs=true&feed=normal", c.URL, c.Database, since)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Authorization", c.authHeader())
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("do request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read response: %w", err)
+	}
+
+	if resp.StatusCode == http.StatusBadRequest && strings.Contains(string(body), "badarg") {
+		return nil, errSequenceInvalidated
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("couchdb error %d: %s", resp.StatusCode, string(body))
+	}
+
+	var result CouchDBChangesResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+
+	return &result, nil
+}
+
+// FetchUpdateSeq returns the database's current update_seq, used as the
+// baseline sequence token after a full fetch so the next sync can go
+// incremental.
+func (c *CouchDBClient) FetchUpdateSeq(ctx context.Context) (string, error) {
+	url := fmt.Sprintf("%s/%s", c.URL, c.Database)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return "", fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Authorization", c.authHeader())
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("do request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("couchdb error %d: %s", resp.StatusCode, string(body))
+	}
+
+	var info struct {
+		UpdateSeq json.RawMessage `json:"update_seq"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return "", fmt.Errorf("decode response: %w", err)
 	}
 
-	return balances
+	return seqToString(info.UpdateSeq), nil
 }
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	_ "embed"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	kmstypes "github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+//go:embed migrations/0005_encrypt_couch_token.sql
+var cryptoMigrationSQL string
+
+func init() {
+	registerSQLMigration(5, "encrypt_couch_token", cryptoMigrationSQL)
+}
+
+// gcmNonceSize is the standard nonce length for AES-GCM; callers that need
+// to split a Keyring ciphertext back into (nonce, sealed) for column storage
+// rely on this being fixed across both providers.
+const gcmNonceSize = 12
+
+// Keyring seals and opens secrets for at-rest storage. Implementations embed
+// a random nonce at the front of the returned ciphertext, so callers that
+// need the nonce as a separate column (as credentials does) can split it off
+// using gcmNonceSize rather than the interface carrying it explicitly.
+type Keyring interface {
+	Encrypt(plaintext []byte) (ciphertext []byte, keyID string, err error)
+	Decrypt(ciphertext []byte, keyID string) ([]byte, error)
+}
+
+func newKeyring(env Env) (Keyring, error) {
+	switch env.EncryptionProvider {
+	case "aws-kms":
+		return NewAWSKMSKeyring(context.Background(), env.EncryptionKMSKeyARN)
+	default:
+		return NewLocalKeyring()
+	}
+}
+
+// LocalKeyring seals secrets with AES-256-GCM using master keys loaded from
+// the environment. ENCRYPTION_KEY is the active key, used to encrypt new
+// values; ENCRYPTION_KEY_<id> entries are kept around so rows sealed under a
+// retired key can still be decrypted after a rotation.
+type LocalKeyring struct {
+	activeKeyID string
+	keys        map[string]cipher.AEAD
+}
+
+func NewLocalKeyring() (*LocalKeyring, error) {
+	active, err := loadAEADKey("ENCRYPTION_KEY")
+	if err != nil {
+		return nil, err
+	}
+
+	kr := &LocalKeyring{
+		activeKeyID: "default",
+		keys:        map[string]cipher.AEAD{"default": active},
+	}
+
+	for _, kv := range os.Environ() {
+		name, _, ok := strings.Cut(kv, "=")
+		if !ok || name == "ENCRYPTION_KEY" || !strings.HasPrefix(name, "ENCRYPTION_KEY_") {
+			continue
+		}
+		aead, err := loadAEADKey(name)
+		if err != nil {
+			return nil, err
+		}
+		kr.keys[strings.TrimPrefix(name, "ENCRYPTION_KEY_")] = aead
+	}
+
+	return kr, nil
+}
+
+func loadAEADKey(envVar string) (cipher.AEAD, error) {
+	raw := os.Getenv(envVar)
+	if raw == "" {
+		return nil, fmt.Errorf("%s is not set", envVar)
+	}
+	key, err := base64.StdEncoding.DecodeString(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be base64: %w", envVar, err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("%s must decode to 32 bytes, got %d", envVar, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (k *LocalKeyring) Encrypt(plaintext []byte) ([]byte, string, error) {
+	aead := k.keys[k.activeKeyID]
+	nonce := make([]byte, gcmNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, "", err
+	}
+	sealed := aead.Seal(nil, nonce, plaintext, nil)
+	return append(nonce, sealed...), k.activeKeyID, nil
+}
+
+func (k *LocalKeyring) Decrypt(ciphertext []byte, keyID string) ([]byte, error) {
+	aead, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption key id %q", keyID)
+	}
+	if len(ciphertext) < gcmNonceSize {
+		return nil, fmt.Errorf("ciphertext shorter than nonce")
+	}
+	nonce, sealed := ciphertext[:gcmNonceSize], ciphertext[gcmNonceSize:]
+	return aead.Open(nil, nonce, sealed, nil)
+}
+
+// AWSKMSKeyring implements envelope encryption: each Encrypt call asks KMS
+// for a fresh data key, uses its plaintext copy to seal the secret locally
+// with AES-256-GCM, and returns the wrapped (KMS-encrypted) data key as
+// keyID so Decrypt can unwrap it through KMS again. The plaintext DEK never
+// leaves memory.
+type AWSKMSKeyring struct {
+	client *kms.Client
+	keyARN string
+}
+
+func NewAWSKMSKeyring(ctx context.Context, keyARN string) (*AWSKMSKeyring, error) {
+	if keyARN == "" {
+		return nil, fmt.Errorf("ENCRYPTION_KMS_KEY_ARN is not set")
+	}
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("load aws config: %w", err)
+	}
+	return &AWSKMSKeyring{client: kms.NewFromConfig(cfg), keyARN: keyARN}, nil
+}
+
+func (k *AWSKMSKeyring) Encrypt(plaintext []byte) ([]byte, string, error) {
+	ctx := context.Background()
+	dataKey, err := k.client.GenerateDataKey(ctx, &kms.GenerateDataKeyInput{
+		KeyId:   &k.keyARN,
+		KeySpec: kmstypes.DataKeySpecAes256,
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("generate data key: %w", err)
+	}
+
+	block, err := aes.NewCipher(dataKey.Plaintext)
+	if err != nil {
+		return nil, "", err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, "", err
+	}
+
+	nonce := make([]byte, gcmNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, "", err
+	}
+	sealed := aead.Seal(nil, nonce, plaintext, nil)
+
+	wrappedDEK := base64.StdEncoding.EncodeToString(dataKey.CiphertextBlob)
+	return append(nonce, sealed...), wrappedDEK, nil
+}
+
+func (k *AWSKMSKeyring) Decrypt(ciphertext []byte, keyID string) ([]byte, error) {
+	if len(ciphertext) < gcmNonceSize {
+		return nil, fmt.Errorf("ciphertext shorter than nonce")
+	}
+	nonce, sealed := ciphertext[:gcmNonceSize], ciphertext[gcmNonceSize:]
+
+	wrappedDEK, err := base64.StdEncoding.DecodeString(keyID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid wrapped data key: %w", err)
+	}
+
+	unwrapped, err := k.client.Decrypt(context.Background(), &kms.DecryptInput{
+		KeyId:          &k.keyARN,
+		CiphertextBlob: wrappedDEK,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unwrap data key: %w", err)
+	}
+
+	block, err := aes.NewCipher(unwrapped.Plaintext)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Open(nil, nonce, sealed, nil)
+}
@@ -2,21 +2,26 @@ package main
 
 import (
 	"context"
+	_ "embed"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
-	"os"
-	"path/filepath"
-	"sort"
-	"strings"
 	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+//go:embed migrations/0001_base_schema.sql
+var baseSchemaMigrationSQL string
+
+func init() {
+	registerSQLMigration(1, "base_schema", baseSchemaMigrationSQL)
+}
+
 type DB struct {
-	Pool *pgxpool.Pool
+	Pool    *pgxpool.Pool
+	keyring Keyring
 }
 
 func initDB(ctx context.Context, env Env) (*DB, error) {
@@ -25,11 +30,21 @@ func initDB(ctx context.Context, env Env) (*DB, error) {
 		return nil, err
 	}
 
-	db := &DB{Pool: pool}
-	if err := db.applyMigrations(ctx, env.MigrationsPath); err != nil {
+	keyring, err := newKeyring(env)
+	if err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("init keyring: %w", err)
+	}
+
+	db := &DB{Pool: pool, keyring: keyring}
+	if err := db.applyMigrations(ctx); err != nil {
 		pool.Close()
 		return nil, err
 	}
+	if err := db.reencryptLegacyCredentials(ctx); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("re-encrypt legacy credentials: %w", err)
+	}
 
 	return db, nil
 }
@@ -38,160 +53,418 @@ func (db *DB) Close() {
 	db.Pool.Close()
 }
 
-func (db *DB) applyMigrations(ctx context.Context, migrationsPath string) error {
-	entries, err := os.ReadDir(migrationsPath)
+func (db *DB) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, 10*time.Second)
+}
+
+type Credentials struct {
+	ID           int64     `json:"id"`
+	OwnerID      *int64    `json:"-"`
+	Email        string    `json:"email"`
+	UserID       string    `json:"userId"`
+	CouchURL     string    `json:"couchUrl"`
+	CouchDB      string    `json:"couchDb"`
+	CouchLogin   string    `json:"couchLogin"`
+	CouchToken   string    `json:"-"`
+	SyncSchedule string    `json:"syncSchedule"`
+	CreatedAt    time.Time `json:"createdAt"`
+	UpdatedAt    time.Time `json:"updatedAt"`
+}
+
+type Account struct {
+	ID           int64      `json:"id"`
+	CredentialID int64      `json:"credentialId"`
+	AccountID    string     `json:"accountId"`
+	Name         string     `json:"name"`
+	CurrencyCode *string    `json:"currencyCode,omitempty"`
+	BalanceCents int64      `json:"balanceCents"`
+	Excluded     bool       `json:"excluded"`
+	Archived     bool       `json:"archived"`
+	LastSync     *time.Time `json:"lastSync,omitempty"`
+}
+
+func (db *DB) SaveCredentials(ctx context.Context, ownerID int64, email, userID, couchURL, couchDB, couchLogin, couchToken string) (*Credentials, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	sealed, keyID, err := db.keyring.Encrypt([]byte(couchToken))
+	if err != nil {
+		return nil, fmt.Errorf("encrypt couch token: %w", err)
+	}
+	nonce, ciphertext := sealed[:gcmNonceSize], sealed[gcmNonceSize:]
+
+	var creds Credentials
+	err = db.Pool.QueryRow(ctx, `
+		INSERT INTO credentials (owner_id, email, user_id, couch_url, couch_db, couch_login, couch_token_ciphertext, key_id, nonce)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (email) DO UPDATE SET
+			owner_id = EXCLUDED.owner_id,
+			user_id = EXCLUDED.user_id,
+			couch_url = EXCLUDED.couch_url,
+			couch_db = EXCLUDED.couch_db,
+			couch_login = EXCLUDED.couch_login,
+			couch_token_ciphertext = EXCLUDED.couch_token_ciphertext,
+			key_id = EXCLUDED.key_id,
+			nonce = EXCLUDED.nonce,
+			updated_at = NOW()
+		RETURNING id, owner_id, email, user_id, couch_url, couch_db, couch_login, sync_schedule, created_at, updated_at
+	`, ownerID, email, userID, couchURL, couchDB, couchLogin, ciphertext, keyID, nonce).Scan(
+		&creds.ID, &creds.OwnerID, &creds.Email, &creds.UserID, &creds.CouchURL, &creds.CouchDB,
+		&creds.CouchLogin, &creds.SyncSchedule, &creds.CreatedAt, &creds.UpdatedAt,
+	)
 	if err != nil {
-		return fmt.Errorf("read migrations: %w", err)
+		return nil, err
 	}
+	creds.CouchToken = couchToken
+	return &creds, nil
+}
 
-	migrationFiles := make([]string, 0, len(entries))
-	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
+// GetCredentialsForUser returns ownerID's connected BudgetBakers account, or
+// nil if they haven't connected one yet. Every handler that used to call the
+// old global GetCredentials now scopes through this instead, so one user's
+// requests can never resolve another's credentials row.
+func (db *DB) GetCredentialsForUser(ctx context.Context, ownerID int64) (*Credentials, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	var creds Credentials
+	var ciphertext, nonce []byte
+	var keyID string
+	err := db.Pool.QueryRow(ctx, `
+		SELECT id, owner_id, email, user_id, couch_url, couch_db, couch_login, couch_token_ciphertext, key_id, nonce, sync_schedule, created_at, updated_at
+		FROM credentials
+		WHERE owner_id = $1
+		ORDER BY id DESC
+		LIMIT 1
+	`, ownerID).Scan(
+		&creds.ID, &creds.OwnerID, &creds.Email, &creds.UserID, &creds.CouchURL, &creds.CouchDB,
+		&creds.CouchLogin, &ciphertext, &keyID, &nonce, &creds.SyncSchedule, &creds.CreatedAt, &creds.UpdatedAt,
+	)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
 		}
-		if strings.HasSuffix(entry.Name(), ".sql") {
-			migrationFiles = append(migrationFiles, entry.Name())
+		return nil, err
+	}
+
+	plaintext, err := db.keyring.Decrypt(append(nonce, ciphertext...), keyID)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt couch token: %w", err)
+	}
+	creds.CouchToken = string(plaintext)
+
+	return &creds, nil
+}
+
+// ListCredentials returns every credentials row (decrypted), for the
+// scheduler to register a sync schedule per credential set on startup.
+func (db *DB) ListCredentials(ctx context.Context) ([]Credentials, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.Pool.Query(ctx, `
+		SELECT id, owner_id, email, user_id, couch_url, couch_db, couch_login, couch_token_ciphertext, key_id, nonce, sync_schedule, created_at, updated_at
+		FROM credentials
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []Credentials
+	for rows.Next() {
+		var creds Credentials
+		var ciphertext, nonce []byte
+		var keyID string
+		if err := rows.Scan(
+			&creds.ID, &creds.OwnerID, &creds.Email, &creds.UserID, &creds.CouchURL, &creds.CouchDB,
+			&creds.CouchLogin, &ciphertext, &keyID, &nonce, &creds.SyncSchedule, &creds.CreatedAt, &creds.UpdatedAt,
+		); err != nil {
+			return nil, err
+		}
+
+		plaintext, err := db.keyring.Decrypt(append(nonce, ciphertext...), keyID)
+		if err != nil {
+			return nil, fmt.Errorf("decrypt couch token for credential %d: %w", creds.ID, err)
 		}
+		creds.CouchToken = string(plaintext)
+
+		result = append(result, creds)
 	}
-	sort.Strings(migrationFiles)
+	return result, rows.Err()
+}
 
-	if len(migrationFiles) == 0 {
-		return errors.New("no migration files found")
+// GetCredentialsByID returns a single credentials row by its primary key,
+// decrypted, regardless of owner — for background jobs (the scheduler
+// ticker, the OAuth refresh loop) that already know the id and aren't acting
+// on behalf of an HTTP request's authenticated user.
+func (db *DB) GetCredentialsByID(ctx context.Context, id int64) (*Credentials, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	var creds Credentials
+	var ciphertext, nonce []byte
+	var keyID string
+	err := db.Pool.QueryRow(ctx, `
+		SELECT id, owner_id, email, user_id, couch_url, couch_db, couch_login, couch_token_ciphertext, key_id, nonce, sync_schedule, created_at, updated_at
+		FROM credentials
+		WHERE id = $1
+	`, id).Scan(
+		&creds.ID, &creds.OwnerID, &creds.Email, &creds.UserID, &creds.CouchURL, &creds.CouchDB,
+		&creds.CouchLogin, &ciphertext, &keyID, &nonce, &creds.SyncSchedule, &creds.CreatedAt, &creds.UpdatedAt,
+	)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
 	}
 
-	_, err = db.Pool.Exec(ctx, `
-		CREATE TABLE IF NOT EXISTS _migrations (
-			name TEXT PRIMARY KEY,
-			applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
-		);
+	plaintext, err := db.keyring.Decrypt(append(nonce, ciphertext...), keyID)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt couch token: %w", err)
+	}
+	creds.CouchToken = string(plaintext)
+
+	return &creds, nil
+}
+
+// GetCredentialOwnerID returns the app user that owns a credentials row, for
+// callers (like the OAuth refresh loop) that only have a credential id to
+// start from.
+func (db *DB) GetCredentialOwnerID(ctx context.Context, credentialID int64) (int64, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	var ownerID int64
+	err := db.Pool.QueryRow(ctx, `SELECT owner_id FROM credentials WHERE id = $1`, credentialID).Scan(&ownerID)
+	return ownerID, err
+}
+
+// UpdateSyncSchedule sets the cron expression the scheduler (see
+// scheduler.go) uses to decide when to run this credential's next sync.
+func (db *DB) UpdateSyncSchedule(ctx context.Context, credentialID int64, schedule string) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := db.Pool.Exec(ctx, `UPDATE credentials SET sync_schedule = $2 WHERE id = $1`, credentialID, schedule)
+	return err
+}
+
+// reencryptLegacyCredentials backfills rows written before the keyring
+// existed: it moves their plaintext couch_token into the encrypted columns
+// on first boot and clears the plaintext, so GetCredentialsForUser,
+// ListCredentials and GetCredentialsByID never need to know about the old
+// column again.
+func (db *DB) reencryptLegacyCredentials(ctx context.Context) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.Pool.Query(ctx, `
+		SELECT id, couch_token FROM credentials
+		WHERE couch_token_ciphertext IS NULL AND couch_token IS NOT NULL
 	`)
 	if err != nil {
-		return fmt.Errorf("create _migrations: %w", err)
+		return err
 	}
 
-	for _, fileName := range migrationFiles {
-		if err := db.applyMigrationFile(ctx, migrationsPath, fileName); err != nil {
+	type legacyRow struct {
+		id    int64
+		token string
+	}
+	var legacy []legacyRow
+	for rows.Next() {
+		var row legacyRow
+		if err := rows.Scan(&row.id, &row.token); err != nil {
+			rows.Close()
 			return err
 		}
+		legacy = append(legacy, row)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, row := range legacy {
+		sealed, keyID, err := db.keyring.Encrypt([]byte(row.token))
+		if err != nil {
+			return fmt.Errorf("encrypt legacy couch token for credential %d: %w", row.id, err)
+		}
+		nonce, ciphertext := sealed[:gcmNonceSize], sealed[gcmNonceSize:]
+
+		if _, err := db.Pool.Exec(ctx, `
+			UPDATE credentials SET couch_token_ciphertext = $2, key_id = $3, nonce = $4, couch_token = NULL
+			WHERE id = $1
+		`, row.id, ciphertext, keyID, nonce); err != nil {
+			return fmt.Errorf("persist re-encrypted couch token for credential %d: %w", row.id, err)
+		}
 	}
 
 	return nil
 }
 
-func (db *DB) applyMigrationFile(ctx context.Context, migrationsPath, fileName string) error {
-	var exists bool
-	err := db.Pool.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM _migrations WHERE name=$1)`, fileName).Scan(&exists)
+// SaveOAuthTokens persists the access/refresh token pair obtained from the
+// OAuth flow (see oauth.go), encrypted the same way couch_token is: a
+// keyring-sealed blob split into ciphertext/key_id/nonce columns.
+func (db *DB) SaveOAuthTokens(ctx context.Context, credentialID int64, tokens OAuthTokenPair, expiresAt time.Time) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	plaintext, err := json.Marshal(tokens)
 	if err != nil {
-		return fmt.Errorf("check migration %s: %w", fileName, err)
-	}
-	if exists {
-		return nil
+		return fmt.Errorf("marshal oauth tokens: %w", err)
 	}
 
-	path := filepath.Join(migrationsPath, fileName)
-	sqlBytes, err := os.ReadFile(path)
+	sealed, keyID, err := db.keyring.Encrypt(plaintext)
 	if err != nil {
-		return fmt.Errorf("read migration %s: %w", fileName, err)
+		return fmt.Errorf("encrypt oauth tokens: %w", err)
 	}
+	nonce, ciphertext := sealed[:gcmNonceSize], sealed[gcmNonceSize:]
+
+	_, err = db.Pool.Exec(ctx, `
+		INSERT INTO oauth_tokens (credential_id, token_ciphertext, key_id, nonce, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (credential_id) DO UPDATE SET
+			token_ciphertext = EXCLUDED.token_ciphertext,
+			key_id = EXCLUDED.key_id,
+			nonce = EXCLUDED.nonce,
+			expires_at = EXCLUDED.expires_at,
+			updated_at = NOW()
+	`, credentialID, ciphertext, keyID, nonce, expiresAt)
+	return err
+}
 
-	tx, err := db.Pool.Begin(ctx)
+// GetOAuthTokens returns the stored token pair for a credential, or nil if
+// this credential was never connected via OAuth (e.g. it still uses the
+// bookmarklet fallback).
+func (db *DB) GetOAuthTokens(ctx context.Context, credentialID int64) (*OAuthTokenPair, time.Time, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	var ciphertext, nonce []byte
+	var keyID string
+	var expiresAt time.Time
+	err := db.Pool.QueryRow(ctx, `
+		SELECT token_ciphertext, key_id, nonce, expires_at FROM oauth_tokens WHERE credential_id = $1
+	`, credentialID).Scan(&ciphertext, &keyID, &nonce, &expiresAt)
 	if err != nil {
-		return fmt.Errorf("begin migration %s: %w", fileName, err)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, time.Time{}, nil
+		}
+		return nil, time.Time{}, err
 	}
 
-	if _, err := tx.Exec(ctx, string(sqlBytes)); err != nil {
-		_ = tx.Rollback(ctx)
-		return fmt.Errorf("exec migration %s: %w", fileName, err)
+	plaintext, err := db.keyring.Decrypt(append(nonce, ciphertext...), keyID)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("decrypt oauth tokens: %w", err)
 	}
 
-	if _, err := tx.Exec(ctx, `INSERT INTO _migrations (name) VALUES ($1)`, fileName); err != nil {
-		_ = tx.Rollback(ctx)
-		return fmt.Errorf("record migration %s: %w", fileName, err)
+	var tokens OAuthTokenPair
+	if err := json.Unmarshal(plaintext, &tokens); err != nil {
+		return nil, time.Time{}, fmt.Errorf("unmarshal oauth tokens: %w", err)
 	}
 
-	if err := tx.Commit(ctx); err != nil {
-		return fmt.Errorf("commit migration %s: %w", fileName, err)
+	return &tokens, expiresAt, nil
+}
+
+// ListOAuthTokensExpiringBefore returns the credential IDs whose OAuth
+// tokens need a refresh before the given time, so startOAuthRefresh can
+// renew them before syncAccounts hits an expired access token.
+func (db *DB) ListOAuthTokensExpiringBefore(ctx context.Context, before time.Time) ([]int64, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.Pool.Query(ctx, `
+		SELECT credential_id FROM oauth_tokens WHERE expires_at < $1
+	`, before)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	log.Printf("Applied migration %s", fileName)
-	return nil
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
 }
 
-func (db *DB) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
-	return context.WithTimeout(ctx, 10*time.Second)
+type SyncRun struct {
+	ID             int64      `json:"id"`
+	CredentialID   int64      `json:"credentialId"`
+	StartedAt      time.Time  `json:"startedAt"`
+	FinishedAt     *time.Time `json:"finishedAt,omitempty"`
+	Status         string     `json:"status"`
+	Error          *string    `json:"error,omitempty"`
+	AccountsSynced int        `json:"accountsSynced"`
 }
 
-type Credentials struct {
-	ID         int64     `json:"id"`
-	Email      string    `json:"email"`
-	UserID     string    `json:"userId"`
-	CouchURL   string    `json:"couchUrl"`
-	CouchDB    string    `json:"couchDb"`
-	CouchLogin string    `json:"couchLogin"`
-	CouchToken string    `json:"-"`
-	CreatedAt  time.Time `json:"createdAt"`
-	UpdatedAt  time.Time `json:"updatedAt"`
-}
+// InsertSyncRun records the start of a sync pass, before syncAccounts has
+// run, so a crash mid-sync still leaves a "running" row behind rather than
+// no record at all.
+func (db *DB) InsertSyncRun(ctx context.Context, credentialID int64) (int64, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
 
-type Account struct {
-	ID           int64      `json:"id"`
-	CredentialID int64      `json:"credentialId"`
-	AccountID    string     `json:"accountId"`
-	Name         string     `json:"name"`
-	CurrencyCode *string    `json:"currencyCode,omitempty"`
-	BalanceCents int64      `json:"balanceCents"`
-	Excluded     bool       `json:"excluded"`
-	Archived     bool       `json:"archived"`
-	LastSync     *time.Time `json:"lastSync,omitempty"`
+	var id int64
+	err := db.Pool.QueryRow(ctx, `
+		INSERT INTO sync_runs (credential_id, started_at, status)
+		VALUES ($1, NOW(), 'running')
+		RETURNING id
+	`, credentialID).Scan(&id)
+	return id, err
 }
 
-func (db *DB) SaveCredentials(ctx context.Context, email, userID, couchURL, couchDB, couchLogin, couchToken string) (*Credentials, error) {
+func (db *DB) CompleteSyncRun(ctx context.Context, id int64, status string, syncErr error, accountsSynced int) error {
 	ctx, cancel := db.withTimeout(ctx)
 	defer cancel()
 
-	var creds Credentials
-	err := db.Pool.QueryRow(ctx, `
-		INSERT INTO credentials (email, user_id, couch_url, couch_db, couch_login, couch_token)
-		VALUES ($1, $2, $3, $4, $5, $6)
-		ON CONFLICT (email) DO UPDATE SET
-			user_id = EXCLUDED.user_id,
-			couch_url = EXCLUDED.couch_url,
-			couch_db = EXCLUDED.couch_db,
-			couch_login = EXCLUDED.couch_login,
-			couch_token = EXCLUDED.couch_token,
-			updated_at = NOW()
-		RETURNING id, email, user_id, couch_url, couch_db, couch_login, couch_token, created_at, updated_at
-	`, email, userID, couchURL, couchDB, couchLogin, couchToken).Scan(
-		&creds.ID, &creds.Email, &creds.UserID, &creds.CouchURL, &creds.CouchDB,
-		&creds.CouchLogin, &creds.CouchToken, &creds.CreatedAt, &creds.UpdatedAt,
-	)
-	if err != nil {
-		return nil, err
+	var errMsg *string
+	if syncErr != nil {
+		msg := syncErr.Error()
+		errMsg = &msg
 	}
-	return &creds, nil
+
+	_, err := db.Pool.Exec(ctx, `
+		UPDATE sync_runs SET finished_at = NOW(), status = $2, error = $3, accounts_synced = $4
+		WHERE id = $1
+	`, id, status, errMsg, accountsSynced)
+	return err
 }
 
-func (db *DB) GetCredentials(ctx context.Context) (*Credentials, error) {
+// ListSyncRuns returns the most recent sync_runs for a credential, newest
+// first, for the UI's sync history view.
+func (db *DB) ListSyncRuns(ctx context.Context, credentialID int64, limit int) ([]SyncRun, error) {
 	ctx, cancel := db.withTimeout(ctx)
 	defer cancel()
 
-	var creds Credentials
-	err := db.Pool.QueryRow(ctx, `
-		SELECT id, email, user_id, couch_url, couch_db, couch_login, couch_token, created_at, updated_at
-		FROM credentials
-		ORDER BY id DESC
-		LIMIT 1
-	`).Scan(
-		&creds.ID, &creds.Email, &creds.UserID, &creds.CouchURL, &creds.CouchDB,
-		&creds.CouchLogin, &creds.CouchToken, &creds.CreatedAt, &creds.UpdatedAt,
-	)
+	rows, err := db.Pool.Query(ctx, `
+		SELECT id, credential_id, started_at, finished_at, status, error, accounts_synced
+		FROM sync_runs
+		WHERE credential_id = $1
+		ORDER BY started_at DESC
+		LIMIT $2
+	`, credentialID, limit)
 	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			return nil, nil
-		}
 		return nil, err
 	}
-	return &creds, nil
+	defer rows.Close()
+
+	var runs []SyncRun
+	for rows.Next() {
+		var run SyncRun
+		if err := rows.Scan(&run.ID, &run.CredentialID, &run.StartedAt, &run.FinishedAt,
+			&run.Status, &run.Error, &run.AccountsSynced); err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
 }
 
 func (db *DB) DeleteCredentials(ctx context.Context, id int64) error {
@@ -202,22 +475,25 @@ func (db *DB) DeleteCredentials(ctx context.Context, id int64) error {
 	return err
 }
 
-func (db *DB) UpsertAccount(ctx context.Context, credID int64, accountID, name string, currencyCode *string, balanceCents int64, excluded, archived bool) (*Account, error) {
+// UpsertAccount tracks an account's identity and metadata. It deliberately
+// does not touch balance_cents: since the ledger (see ledger.go) is the
+// source of truth for balances, that column is kept in sync separately by
+// refreshAccountSnapshot after postings are inserted.
+func (db *DB) UpsertAccount(ctx context.Context, credID int64, accountID, name string, currencyCode *string, excluded, archived bool) (*Account, error) {
 	ctx, cancel := db.withTimeout(ctx)
 	defer cancel()
 
 	var acc Account
 	err := db.Pool.QueryRow(ctx, `
 		INSERT INTO accounts (credential_id, account_id, name, currency_code, balance_cents, excluded, archived, last_sync)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, NOW())
+		VALUES ($1, $2, $3, $4, 0, $5, $6, NOW())
 		ON CONFLICT (credential_id, account_id) DO UPDATE SET
 			name = EXCLUDED.name,
 			currency_code = EXCLUDED.currency_code,
-			balance_cents = EXCLUDED.balance_cents,
 			archived = EXCLUDED.archived,
 			last_sync = NOW()
 		RETURNING id, credential_id, account_id, name, currency_code, balance_cents, excluded, archived, last_sync
-	`, credID, accountID, name, currencyCode, balanceCents, excluded, archived).Scan(
+	`, credID, accountID, name, currencyCode, excluded, archived).Scan(
 		&acc.ID, &acc.CredentialID, &acc.AccountID, &acc.Name, &acc.CurrencyCode,
 		&acc.BalanceCents, &acc.Excluded, &acc.Archived, &acc.LastSync,
 	)
@@ -227,16 +503,89 @@ func (db *DB) UpsertAccount(ctx context.Context, credID int64, accountID, name s
 	return &acc, nil
 }
 
-func (db *DB) ListAccounts(ctx context.Context, credID int64) ([]Account, error) {
+// UpdateAccountBalance persists an account's cached balance_cents: the
+// ledger-derived balance after a sync, or the balance a manual adjustment
+// sets (see adjustments.go).
+func (db *DB) UpdateAccountBalance(ctx context.Context, accountID int64, balanceCents int64) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := db.Pool.Exec(ctx, `UPDATE accounts SET balance_cents = $2 WHERE id = $1`, accountID, balanceCents)
+	return err
+}
+
+// GetAccountIDByBBID resolves an already-tracked account by its BudgetBakers
+// account id. This is what lets an incremental sync book postings against an
+// account whose doc didn't change in this batch (the common case — only the
+// record changed).
+func (db *DB) GetAccountIDByBBID(ctx context.Context, credID int64, bbAccountID string) (int64, string, bool, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	var id int64
+	var currencyCode *string
+	err := db.Pool.QueryRow(ctx, `
+		SELECT id, currency_code FROM accounts WHERE credential_id = $1 AND account_id = $2
+	`, credID, bbAccountID).Scan(&id, &currencyCode)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, "", false, nil
+		}
+		return 0, "", false, err
+	}
+
+	code := ""
+	if currencyCode != nil {
+		code = *currencyCode
+	}
+	return id, code, true, nil
+}
+
+// GetSyncState returns the last persisted CouchDB _changes sequence token
+// for a credential, or "" if none has been recorded yet (forcing a full
+// resync).
+func (db *DB) GetSyncState(ctx context.Context, credID int64) (string, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	var lastSeq string
+	err := db.Pool.QueryRow(ctx, `
+		SELECT last_seq FROM couchdb_sync_state WHERE credential_id = $1
+	`, credID).Scan(&lastSeq)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", nil
+		}
+		return "", err
+	}
+	return lastSeq, nil
+}
+
+func (db *DB) UpsertSyncState(ctx context.Context, credID int64, lastSeq string) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := db.Pool.Exec(ctx, `
+		INSERT INTO couchdb_sync_state (credential_id, last_seq, updated_at)
+		VALUES ($1, $2, NOW())
+		ON CONFLICT (credential_id) DO UPDATE SET last_seq = EXCLUDED.last_seq, updated_at = NOW()
+	`, credID, lastSeq)
+	return err
+}
+
+// ListAccountsForUser returns every account belonging to ownerID's connected
+// credential, regardless of which credentials row id it lives under.
+func (db *DB) ListAccountsForUser(ctx context.Context, ownerID int64) ([]Account, error) {
 	ctx, cancel := db.withTimeout(ctx)
 	defer cancel()
 
 	rows, err := db.Pool.Query(ctx, `
-		SELECT id, credential_id, account_id, name, currency_code, balance_cents, excluded, archived, last_sync
-		FROM accounts
-		WHERE credential_id = $1
-		ORDER BY name ASC
-	`, credID)
+		SELECT a.id, a.credential_id, a.account_id, a.name, a.currency_code, a.balance_cents, a.excluded, a.archived, a.last_sync
+		FROM accounts a
+		JOIN credentials c ON c.id = a.credential_id
+		WHERE c.owner_id = $1
+		ORDER BY a.name ASC
+	`, ownerID)
 	if err != nil {
 		return nil, err
 	}
@@ -271,37 +620,49 @@ func (db *DB) GetTotalBalanceUSD(ctx context.Context, credID int64) (float64, er
 	var total float64
 	err := db.Pool.QueryRow(ctx, `
 		SELECT COALESCE(SUM(
-			CASE 
-				WHEN currency_code = 'USD' THEN balance_cents::float / 100
-				WHEN currency_code = 'EUR' THEN balance_cents::float / 100 * 1.08
-				WHEN currency_code = 'RUB' THEN balance_cents::float / 100 / 95
-				WHEN currency_code = 'GEL' THEN balance_cents::float / 100 / 2.7
-				WHEN currency_code = 'KZT' THEN balance_cents::float / 100 / 450
-				WHEN currency_code = 'TRY' THEN balance_cents::float / 100 / 35
-				ELSE balance_cents::float / 100
-			END
+			a.balance_cents::float / 100 * COALESCE(fx.rate_to_usd, 1)
 		), 0)
-		FROM accounts
-		WHERE credential_id = $1 AND excluded = FALSE AND archived = FALSE
+		FROM accounts a
+		LEFT JOIN LATERAL (
+			SELECT rate_to_usd
+			FROM fx_rates
+			WHERE code = a.currency_code AND day <= CURRENT_DATE
+			ORDER BY day DESC
+			LIMIT 1
+		) fx ON true
+		WHERE a.credential_id = $1 AND a.excluded = FALSE AND a.archived = FALSE
 	`, credID).Scan(&total)
 	return total, err
 }
 
+// BalanceHistoryPoint's Source distinguishes a point snapshotted from a
+// CouchDB sync ("sync") from one a user entered by hand ("manual" — see
+// adjustments.go). SupersededBy is set once a manual entry has been edited
+// via PATCH /api/adjustments/{id}, pointing at the row that replaced it.
 type BalanceHistoryPoint struct {
+	ID           int64     `json:"id"`
 	BalanceCents int64     `json:"balanceCents"`
 	BalanceUSD   *float64  `json:"balanceUsd,omitempty"`
+	Source       string    `json:"source"`
+	Note         *string   `json:"note,omitempty"`
+	SupersededBy *int64    `json:"supersededBy,omitempty"`
 	RecordedAt   time.Time `json:"recordedAt"`
 }
 
-func (db *DB) InsertBalanceHistory(ctx context.Context, accountID int64, balanceCents int64, balanceUSD *float64) error {
+// InsertBalanceHistory records a balance snapshot tagged with its source
+// ("sync" from refreshAccountSnapshot, "manual" from adjustments.go) and
+// returns the inserted row's id.
+func (db *DB) InsertBalanceHistory(ctx context.Context, accountID int64, balanceCents int64, balanceUSD *float64, source string, note *string, recordedAt time.Time) (int64, error) {
 	ctx, cancel := db.withTimeout(ctx)
 	defer cancel()
 
-	_, err := db.Pool.Exec(ctx, `
-		INSERT INTO balance_history (account_id, balance_cents, balance_usd)
-		VALUES ($1, $2, $3)
-	`, accountID, balanceCents, balanceUSD)
-	return err
+	var id int64
+	err := db.Pool.QueryRow(ctx, `
+		INSERT INTO balance_history (account_id, balance_cents, balance_usd, source, note, recorded_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id
+	`, accountID, balanceCents, balanceUSD, source, note, recordedAt).Scan(&id)
+	return id, err
 }
 
 func (db *DB) GetAccountHistory(ctx context.Context, accountID int64, from, to *time.Time) ([]BalanceHistoryPoint, error) {
@@ -309,7 +670,7 @@ func (db *DB) GetAccountHistory(ctx context.Context, accountID int64, from, to *
 	defer cancel()
 
 	query := `
-		SELECT balance_cents, balance_usd, recorded_at
+		SELECT id, balance_cents, balance_usd, source, note, superseded_by, recorded_at
 		FROM balance_history
 		WHERE account_id = $1
 	`
@@ -339,7 +700,7 @@ func (db *DB) GetAccountHistory(ctx context.Context, accountID int64, from, to *
 	var points []BalanceHistoryPoint
 	for rows.Next() {
 		var p BalanceHistoryPoint
-		if err := rows.Scan(&p.BalanceCents, &p.BalanceUSD, &p.RecordedAt); err != nil {
+		if err := rows.Scan(&p.ID, &p.BalanceCents, &p.BalanceUSD, &p.Source, &p.Note, &p.SupersededBy, &p.RecordedAt); err != nil {
 			return nil, err
 		}
 		points = append(points, p)
@@ -347,6 +708,84 @@ func (db *DB) GetAccountHistory(ctx context.Context, accountID int64, from, to *
 	return points, rows.Err()
 }
 
+// ListBalanceHistoryDaysMissingRates returns the distinct days that appear
+// in balance_history for an account whose currency has no fx_rates entry
+// for that day yet, so backfillHistoricalRates knows exactly which days to
+// fetch instead of re-fetching everything.
+func (db *DB) ListBalanceHistoryDaysMissingRates(ctx context.Context) ([]time.Time, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.Pool.Query(ctx, `
+		SELECT DISTINCT date(bh.recorded_at) AS day
+		FROM balance_history bh
+		JOIN accounts a ON a.id = bh.account_id
+		WHERE a.currency_code IS NOT NULL
+		AND NOT EXISTS (
+			SELECT 1 FROM fx_rates fx
+			WHERE fx.code = a.currency_code AND fx.day = date(bh.recorded_at)
+		)
+		ORDER BY day ASC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var days []time.Time
+	for rows.Next() {
+		var day time.Time
+		if err := rows.Scan(&day); err != nil {
+			return nil, err
+		}
+		days = append(days, day)
+	}
+	return days, rows.Err()
+}
+
+type balanceHistoryRecomputeRow struct {
+	ID           int64
+	CurrencyCode string
+	BalanceCents int64
+	RecordedAt   time.Time
+}
+
+// ListBalanceHistoryForRecompute returns every balance_history row together
+// with its account's currency, for recomputeBalanceHistoryUSD to re-derive
+// balance_usd from freshly backfilled fx_rates.
+func (db *DB) ListBalanceHistoryForRecompute(ctx context.Context) ([]balanceHistoryRecomputeRow, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.Pool.Query(ctx, `
+		SELECT bh.id, COALESCE(a.currency_code, ''), bh.balance_cents, bh.recorded_at
+		FROM balance_history bh
+		JOIN accounts a ON a.id = bh.account_id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []balanceHistoryRecomputeRow
+	for rows.Next() {
+		var row balanceHistoryRecomputeRow
+		if err := rows.Scan(&row.ID, &row.CurrencyCode, &row.BalanceCents, &row.RecordedAt); err != nil {
+			return nil, err
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+func (db *DB) UpdateBalanceHistoryUSD(ctx context.Context, id int64, balanceUSD float64) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := db.Pool.Exec(ctx, `UPDATE balance_history SET balance_usd = $2 WHERE id = $1`, id, balanceUSD)
+	return err
+}
+
 func (db *DB) GetAccountByID(ctx context.Context, id int64) (*Account, error) {
 	ctx, cancel := db.withTimeout(ctx)
 	defer cancel()
@@ -368,3 +807,29 @@ func (db *DB) GetAccountByID(ctx context.Context, id int64) (*Account, error) {
 	}
 	return &acc, nil
 }
+
+// GetAccountByIDForUser is GetAccountByID scoped to accounts owned (via their
+// credential row) by ownerID, so one user can't pull another's account by
+// guessing its id.
+func (db *DB) GetAccountByIDForUser(ctx context.Context, id, ownerID int64) (*Account, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	var acc Account
+	err := db.Pool.QueryRow(ctx, `
+		SELECT a.id, a.credential_id, a.account_id, a.name, a.currency_code, a.balance_cents, a.excluded, a.archived, a.last_sync
+		FROM accounts a
+		JOIN credentials c ON c.id = a.credential_id
+		WHERE a.id = $1 AND c.owner_id = $2
+	`, id, ownerID).Scan(
+		&acc.ID, &acc.CredentialID, &acc.AccountID, &acc.Name, &acc.CurrencyCode,
+		&acc.BalanceCents, &acc.Excluded, &acc.Archived, &acc.LastSync,
+	)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &acc, nil
+}
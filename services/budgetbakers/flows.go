@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"time"
+)
+
+//go:embed migrations/0007_deposits_withdrawals.sql
+var flowsMigrationSQL string
+
+func init() {
+	registerSQLMigration(7, "deposits_withdrawals", flowsMigrationSQL)
+}
+
+// Deposit and Withdrawal are external cash flows into or out of an account —
+// as distinct from transfers between the user's own tracked accounts, which
+// only move money around the ledger and don't affect net contributions. This
+// is what lets PnL be computed as balance minus netContributions instead of
+// the misleading raw balance alone.
+type Deposit struct {
+	ID           int64     `json:"id"`
+	AccountID    int64     `json:"accountId"`
+	AmountCents  int64     `json:"amountCents"`
+	CurrencyCode *string   `json:"currencyCode,omitempty"`
+	AmountUSD    *float64  `json:"amountUsd,omitempty"`
+	RecordedAt   time.Time `json:"recordedAt"`
+	ExternalTxID *string   `json:"externalTxId,omitempty"`
+}
+
+type Withdrawal struct {
+	ID           int64     `json:"id"`
+	AccountID    int64     `json:"accountId"`
+	AmountCents  int64     `json:"amountCents"`
+	CurrencyCode *string   `json:"currencyCode,omitempty"`
+	AmountUSD    *float64  `json:"amountUsd,omitempty"`
+	RecordedAt   time.Time `json:"recordedAt"`
+	ExternalTxID *string   `json:"externalTxId,omitempty"`
+}
+
+// Flow is the common shape returned by ListAccountFlows, combining deposits
+// and withdrawals into a single chronological, paginated stream.
+type Flow struct {
+	Kind         string    `json:"kind"` // "deposit" or "withdrawal"
+	AccountID    int64     `json:"accountId"`
+	AmountCents  int64     `json:"amountCents"`
+	CurrencyCode *string   `json:"currencyCode,omitempty"`
+	AmountUSD    *float64  `json:"amountUsd,omitempty"`
+	RecordedAt   time.Time `json:"recordedAt"`
+}
+
+// InsertDeposit records an external deposit. Idempotent on external_tx_id, so
+// re-syncing the same BudgetBakers history never double-counts a flow.
+func (db *DB) InsertDeposit(ctx context.Context, accountID int64, amountCents int64, currencyCode *string, amountUSD *float64, recordedAt time.Time, externalTxID string) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := db.Pool.Exec(ctx, `
+		INSERT INTO deposits (account_id, amount_cents, currency_code, amount_usd, recorded_at, external_tx_id)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (external_tx_id) DO NOTHING
+	`, accountID, amountCents, currencyCode, amountUSD, recordedAt, externalTxID)
+	return err
+}
+
+func (db *DB) InsertWithdrawal(ctx context.Context, accountID int64, amountCents int64, currencyCode *string, amountUSD *float64, recordedAt time.Time, externalTxID string) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := db.Pool.Exec(ctx, `
+		INSERT INTO withdrawals (account_id, amount_cents, currency_code, amount_usd, recorded_at, external_tx_id)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (external_tx_id) DO NOTHING
+	`, accountID, amountCents, currencyCode, amountUSD, recordedAt, externalTxID)
+	return err
+}
+
+// GetNetContributions returns sum(deposits) - sum(withdrawals) in USD across
+// every account under credID, so the frontend can plot PnL = balance -
+// netContributions alongside the market-valued balance from GetTotalBalanceUSD.
+func (db *DB) GetNetContributions(ctx context.Context, credID int64) (float64, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	var net float64
+	err := db.Pool.QueryRow(ctx, `
+		SELECT
+			COALESCE((
+				SELECT SUM(d.amount_usd) FROM deposits d
+				JOIN accounts a ON a.id = d.account_id
+				WHERE a.credential_id = $1
+			), 0)
+			-
+			COALESCE((
+				SELECT SUM(w.amount_usd) FROM withdrawals w
+				JOIN accounts a ON a.id = w.account_id
+				WHERE a.credential_id = $1
+			), 0)
+	`, credID).Scan(&net)
+	return net, err
+}
+
+// ListAccountFlows returns the combined, paginated deposit/withdrawal stream
+// for one account, newest first.
+func (db *DB) ListAccountFlows(ctx context.Context, accountID int64, from, to *time.Time, limit, offset int) ([]Flow, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		SELECT kind, account_id, amount_cents, currency_code, amount_usd, recorded_at FROM (
+			SELECT 'deposit' AS kind, account_id, amount_cents, currency_code, amount_usd, recorded_at FROM deposits WHERE account_id = $1
+			UNION ALL
+			SELECT 'withdrawal' AS kind, account_id, amount_cents, currency_code, amount_usd, recorded_at FROM withdrawals WHERE account_id = $1
+		) flows
+		WHERE ($2::timestamptz IS NULL OR recorded_at >= $2)
+		AND ($3::timestamptz IS NULL OR recorded_at <= $3)
+		ORDER BY recorded_at DESC
+		LIMIT $4 OFFSET $5
+	`
+	args := []interface{}{accountID, from, to, limit, offset}
+
+	rows, err := db.Pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var flows []Flow
+	for rows.Next() {
+		var f Flow
+		if err := rows.Scan(&f.Kind, &f.AccountID, &f.AmountCents, &f.CurrencyCode, &f.AmountUSD, &f.RecordedAt); err != nil {
+			return nil, err
+		}
+		flows = append(flows, f)
+	}
+	return flows, rows.Err()
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+//go:embed migrations/0003_fx_rates.sql
+var fxMigrationSQL string
+
+func init() {
+	registerSQLMigration(3, "fx_rates", fxMigrationSQL)
+}
+
+// FXProvider resolves a currency's rate to USD as of a given time.
+type FXProvider interface {
+	RateToUSD(ctx context.Context, code string, at time.Time) (float64, error)
+}
+
+// StaticProvider mirrors the table that used to be inlined in GetTotalBalanceUSD.
+// It is used as the fallback whenever a day/currency has no entry in fx_rates.
+type StaticProvider struct{}
+
+var staticRatesToUSD = map[string]float64{
+	"USD": 1,
+	"EUR": 1.08,
+	"RUB": 1.0 / 95,
+	"GEL": 1.0 / 2.7,
+	"KZT": 1.0 / 450,
+	"TRY": 1.0 / 35,
+}
+
+func (StaticProvider) RateToUSD(_ context.Context, code string, _ time.Time) (float64, error) {
+	if rate, ok := staticRatesToUSD[code]; ok {
+		return rate, nil
+	}
+	return 1, nil
+}
+
+// ECBProvider reads fx_rates populated from the ECB daily reference feed (or any
+// configurable HTTP source in the same eurofxref-daily.xml shape), falling back
+// to StaticProvider for currencies or days it hasn't fetched yet.
+type ECBProvider struct {
+	db       *DB
+	fallback FXProvider
+}
+
+func NewECBProvider(db *DB) *ECBProvider {
+	return &ECBProvider{db: db, fallback: StaticProvider{}}
+}
+
+func (p *ECBProvider) RateToUSD(ctx context.Context, code string, at time.Time) (float64, error) {
+	rate, err := p.db.GetFXRate(ctx, code, at)
+	if err == nil {
+		return rate, nil
+	}
+	return p.fallback.RateToUSD(ctx, code, at)
+}
+
+type ecbEnvelope struct {
+	Cube struct {
+		Cube struct {
+			Time string `xml:"time,attr"`
+			Cube []struct {
+				Currency string  `xml:"currency,attr"`
+				Rate     float64 `xml:"rate,attr"`
+			} `xml:"Cube"`
+		} `xml:"Cube"`
+	} `xml:"Cube"`
+}
+
+// refreshFromSource fetches the daily EUR-denominated reference rates and
+// upserts them into fx_rates as rate-to-USD, using EUR/USD from the same feed
+// to convert. If EUR/USD isn't present (e.g. a different feed is configured),
+// EUR is taken as 1 and each currency is stored as EUR per unit (1/rate)
+// rather than USD per unit.
+func (p *ECBProvider) refreshFromSource(ctx context.Context, sourceURL string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sourceURL, nil)
+	if err != nil {
+		return fmt.Errorf("build fx request: %w", err)
+	}
+
+	client := &http.Client{Timeout: 15 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetch fx rates: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("fx source returned %d: %s", resp.StatusCode, string(body))
+	}
+
+	var envelope ecbEnvelope
+	if err := xml.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf("decode fx rates: %w", err)
+	}
+
+	day, err := time.Parse("2006-01-02", envelope.Cube.Cube.Time)
+	if err != nil {
+		day = time.Now().UTC()
+	}
+
+	usdPerEUR := 1.0
+	for _, c := range envelope.Cube.Cube.Cube {
+		if c.Currency == "USD" {
+			usdPerEUR = c.Rate
+			break
+		}
+	}
+
+	if err := p.db.UpsertFXRate(ctx, "EUR", day, usdPerEUR/1); err != nil {
+		return err
+	}
+	for _, c := range envelope.Cube.Cube.Cube {
+		if c.Currency == "USD" || c.Rate == 0 {
+			continue
+		}
+		rateToUSD := usdPerEUR / c.Rate
+		if err := p.db.UpsertFXRate(ctx, c.Currency, day, rateToUSD); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ExchangeRateHostProvider reads fx_rates populated from exchangerate.host,
+// falling back to StaticProvider for currencies or days it hasn't fetched
+// yet. Unlike ECBProvider it can also fetch a specific historical day
+// on demand, which is what backfillHistoricalRates uses.
+type ExchangeRateHostProvider struct {
+	db       *DB
+	fallback FXProvider
+}
+
+func NewExchangeRateHostProvider(db *DB) *ExchangeRateHostProvider {
+	return &ExchangeRateHostProvider{db: db, fallback: StaticProvider{}}
+}
+
+func (p *ExchangeRateHostProvider) RateToUSD(ctx context.Context, code string, at time.Time) (float64, error) {
+	rate, err := p.db.GetFXRate(ctx, code, at)
+	if err == nil {
+		return rate, nil
+	}
+	return p.fallback.RateToUSD(ctx, code, at)
+}
+
+type exchangeRateHostResponse struct {
+	Success bool               `json:"success"`
+	Date    string             `json:"date"`
+	Rates   map[string]float64 `json:"rates"`
+}
+
+// fetchRatesForDay calls exchangerate.host's historical endpoint (base=USD,
+// so each returned rate is units of that currency per USD; the 1/rate
+// conversion below turns it into USD per unit) and upserts every currency it
+// returns into fx_rates for that day.
+func (p *ExchangeRateHostProvider) fetchRatesForDay(ctx context.Context, sourceURL string, day time.Time) error {
+	dateStr := day.Format("2006-01-02")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sourceURL+"/"+dateStr, nil)
+	if err != nil {
+		return fmt.Errorf("build fx request: %w", err)
+	}
+	q := req.URL.Query()
+	q.Set("base", "USD")
+	req.URL.RawQuery = q.Encode()
+
+	client := &http.Client{Timeout: 15 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetch fx rates: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("fx source returned %d: %s", resp.StatusCode, string(body))
+	}
+
+	var parsed exchangeRateHostResponse
+	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return fmt.Errorf("decode fx rates: %w", err)
+	}
+	if !parsed.Success {
+		return fmt.Errorf("fx source reported failure for %s", dateStr)
+	}
+
+	if err := p.db.UpsertFXRate(ctx, "USD", day, 1); err != nil {
+		return err
+	}
+	for code, unitsPerUSD := range parsed.Rates {
+		if code == "USD" || unitsPerUSD == 0 {
+			continue
+		}
+		if err := p.db.UpsertFXRate(ctx, code, day, 1/unitsPerUSD); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// startFXRefresh periodically refreshes fx_rates from env.FXSourceURL. It is a
+// no-op for StaticProvider, since that provider needs no background work.
+func (s *server) startFXRefresh() {
+	refresh := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		switch provider := s.fx.(type) {
+		case *ECBProvider:
+			return provider.refreshFromSource(ctx, s.env.FXSourceURL)
+		case *ExchangeRateHostProvider:
+			return provider.fetchRatesForDay(ctx, s.env.FXSourceURL, time.Now().UTC())
+		default:
+			return nil
+		}
+	}
+
+	if err := refresh(); err != nil {
+		log.Printf("fx refresh failed: %v", err)
+	}
+	ticker := time.NewTicker(s.env.FXRefreshInterval)
+	go func() {
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := refresh(); err != nil {
+				log.Printf("fx refresh failed: %v", err)
+			}
+		}
+	}()
+}
+
+// backfillHistoricalRates fetches fx_rates for every day present in
+// balance_history that isn't already covered, then recomputes balance_usd
+// for every balance_history row (see recomputeBalanceHistoryUSD). Providers
+// other than ExchangeRateHostProvider (like StaticProvider) can't fetch a
+// specific historical day: for them it returns an error and updates nothing.
+func (s *server) backfillHistoricalRates(ctx context.Context) (int, error) {
+	hostProvider, ok := s.fx.(*ExchangeRateHostProvider)
+	if !ok {
+		return 0, fmt.Errorf("fx provider %T does not support historical backfill", s.fx)
+	}
+
+	days, err := s.db.ListBalanceHistoryDaysMissingRates(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("list days missing fx rates: %w", err)
+	}
+
+	for _, day := range days {
+		if err := hostProvider.fetchRatesForDay(ctx, s.env.FXSourceURL, day); err != nil {
+			return 0, fmt.Errorf("fetch rates for %s: %w", day.Format("2006-01-02"), err)
+		}
+	}
+
+	return s.recomputeBalanceHistoryUSD(ctx)
+}
+
+// recomputeBalanceHistoryUSD re-derives balance_usd for every balance_history
+// row from the now-backfilled fx_rates, so rows converted against the
+// StaticProvider fallback before rates were known get corrected.
+func (s *server) recomputeBalanceHistoryUSD(ctx context.Context) (int, error) {
+	rows, err := s.db.ListBalanceHistoryForRecompute(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("list balance history rows: %w", err)
+	}
+
+	updated := 0
+	for _, row := range rows {
+		balanceUSD := s.convertToUSD(ctx, row.BalanceCents, row.CurrencyCode, row.RecordedAt)
+		if err := s.db.UpdateBalanceHistoryUSD(ctx, row.ID, balanceUSD); err != nil {
+			return updated, fmt.Errorf("update balance history row %d: %w", row.ID, err)
+		}
+		updated++
+	}
+
+	return updated, nil
+}
+
+// handleRebuildRates backfills any missing historical fx_rates and
+// recomputes balance_history.balance_usd from them, for when a provider
+// change or outage left balances converted at a stale or fallback rate.
+func (s *server) handleRebuildRates(w http.ResponseWriter, r *http.Request) {
+	updated, err := s.backfillHistoricalRates(r.Context())
+	if err != nil {
+		log.Printf("failed to rebuild fx rates: %v", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":      "ok",
+		"rowsUpdated": updated,
+	})
+}
+
+func (db *DB) UpsertFXRate(ctx context.Context, code string, day time.Time, rateToUSD float64) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := db.Pool.Exec(ctx, `
+		INSERT INTO fx_rates (code, day, rate_to_usd)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (code, day) DO UPDATE SET rate_to_usd = EXCLUDED.rate_to_usd
+	`, code, day.Format("2006-01-02"), rateToUSD)
+	return err
+}
+
+func (db *DB) GetFXRate(ctx context.Context, code string, at time.Time) (float64, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	var rate float64
+	err := db.Pool.QueryRow(ctx, `
+		SELECT rate_to_usd FROM fx_rates
+		WHERE code = $1 AND day <= $2
+		ORDER BY day DESC
+		LIMIT 1
+	`, code, at.Format("2006-01-02")).Scan(&rate)
+	return rate, err
+}
+
+type fxRateRow struct {
+	Code      string  `json:"code"`
+	Day       string  `json:"day"`
+	RateToUSD float64 `json:"rateToUsd"`
+}
+
+func (db *DB) ListLatestFXRates(ctx context.Context) ([]fxRateRow, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.Pool.Query(ctx, `
+		SELECT DISTINCT ON (code) code, day, rate_to_usd
+		FROM fx_rates
+		ORDER BY code, day DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []fxRateRow
+	for rows.Next() {
+		var row fxRateRow
+		var day time.Time
+		if err := rows.Scan(&row.Code, &day, &row.RateToUSD); err != nil {
+			return nil, err
+		}
+		row.Day = day.Format("2006-01-02")
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+func (s *server) handleGetFXRates(w http.ResponseWriter, r *http.Request) {
+	rates, err := s.db.ListLatestFXRates(r.Context())
+	if err != nil {
+		log.Printf("failed to list fx rates: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to list fx rates")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"rates": rates})
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"strconv"
@@ -36,14 +38,15 @@ func (s *server) handleSaveCredentials(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	creds, err := s.db.SaveCredentials(r.Context(), req.Email, req.UserID, req.CouchURL, req.CouchDB, req.CouchLogin, req.CouchToken)
+	owner := userFromContext(r.Context())
+	creds, err := s.db.SaveCredentials(r.Context(), owner.ID, req.Email, req.UserID, req.CouchURL, req.CouchDB, req.CouchLogin, req.CouchToken)
 	if err != nil {
 		log.Printf("Failed to save credentials: %v", err)
 		writeError(w, http.StatusInternalServerError, "failed to save credentials")
 		return
 	}
 
-	go s.syncAccounts(creds)
+	go s.runTrackedSync(creds)
 
 	writeJSON(w, http.StatusOK, map[string]interface{}{
 		"status":  "ok",
@@ -53,7 +56,7 @@ func (s *server) handleSaveCredentials(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *server) handleGetCredentials(w http.ResponseWriter, r *http.Request) {
-	creds, err := s.db.GetCredentials(r.Context())
+	creds, err := s.db.GetCredentialsForUser(r.Context(), userFromContext(r.Context()).ID)
 	if err != nil {
 		log.Printf("Failed to get credentials: %v", err)
 		writeError(w, http.StatusInternalServerError, "failed to get credentials")
@@ -76,7 +79,7 @@ func (s *server) handleGetCredentials(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *server) handleDeleteCredentials(w http.ResponseWriter, r *http.Request) {
-	creds, err := s.db.GetCredentials(r.Context())
+	creds, err := s.db.GetCredentialsForUser(r.Context(), userFromContext(r.Context()).ID)
 	if err != nil || creds == nil {
 		writeError(w, http.StatusNotFound, "no credentials found")
 		return
@@ -92,7 +95,7 @@ func (s *server) handleDeleteCredentials(w http.ResponseWriter, r *http.Request)
 }
 
 func (s *server) handleListAccounts(w http.ResponseWriter, r *http.Request) {
-	creds, err := s.db.GetCredentials(r.Context())
+	creds, err := s.db.GetCredentialsForUser(r.Context(), userFromContext(r.Context()).ID)
 	if err != nil {
 		log.Printf("Failed to get credentials: %v", err)
 		writeError(w, http.StatusInternalServerError, "failed to get credentials")
@@ -107,7 +110,7 @@ func (s *server) handleListAccounts(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	accounts, err := s.db.ListAccounts(r.Context(), creds.ID)
+	accounts, err := s.db.ListAccountsForUser(r.Context(), userFromContext(r.Context()).ID)
 	if err != nil {
 		log.Printf("Failed to list accounts: %v", err)
 		writeError(w, http.StatusInternalServerError, "failed to list accounts")
@@ -142,6 +145,17 @@ func (s *server) handleUpdateAccount(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	acc, err := s.db.GetAccountByIDForUser(r.Context(), id, userFromContext(r.Context()).ID)
+	if err != nil {
+		log.Printf("Failed to get account: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to get account")
+		return
+	}
+	if acc == nil {
+		writeError(w, http.StatusNotFound, "account not found")
+		return
+	}
+
 	if req.Excluded != nil {
 		if err := s.db.UpdateAccountExcluded(r.Context(), id, *req.Excluded); err != nil {
 			log.Printf("Failed to update account: %v", err)
@@ -154,13 +168,13 @@ func (s *server) handleUpdateAccount(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *server) handleSync(w http.ResponseWriter, r *http.Request) {
-	creds, err := s.db.GetCredentials(r.Context())
+	creds, err := s.db.GetCredentialsForUser(r.Context(), userFromContext(r.Context()).ID)
 	if err != nil || creds == nil {
 		writeError(w, http.StatusNotFound, "no credentials found")
 		return
 	}
 
-	go s.syncAccounts(creds)
+	go s.runTrackedSync(creds)
 
 	writeJSON(w, http.StatusAccepted, map[string]string{
 		"status":  "syncing",
@@ -168,60 +182,238 @@ func (s *server) handleSync(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func convertToUSD(balanceCents int64, currencyCode string) float64 {
+func (s *server) convertToUSD(ctx context.Context, balanceCents int64, currencyCode string, at time.Time) float64 {
 	amount := float64(balanceCents) / 100
-	switch currencyCode {
-	case "USD":
+	if currencyCode == "" {
 		return amount
-	case "EUR":
-		return amount * 1.08
-	case "RUB":
-		return amount / 95
-	case "GEL":
-		return amount / 2.7
-	case "KZT":
-		return amount / 450
-	case "TRY":
-		return amount / 35
-	default:
+	}
+	rate, err := s.fx.RateToUSD(ctx, currencyCode, at)
+	if err != nil {
+		log.Printf("failed to resolve fx rate for %s: %v", currencyCode, err)
 		return amount
 	}
+	return amount * rate
 }
 
-func (s *server) syncAccounts(creds *Credentials) {
+// syncAccounts performs one sync pass for creds. It fetches everything
+// changed since the last persisted CouchDB sequence token (or everything, on
+// the first sync), upserts account metadata, books ledger transactions for
+// new and deleted records, then snapshots the resulting balances. The
+// sequence token is only persisted once all of that succeeds, so a failed
+// sync is retried from the same point rather than skipping data.
+//
+// It returns the number of accounts seen in this pass so callers (the
+// scheduler's sync_runs bookkeeping) can record it alongside success/error.
+func (s *server) syncAccounts(creds *Credentials) (int, error) {
 	ctx := context.Background()
 	log.Printf("Starting sync for %s", creds.Email)
+	s.syncEvents.Publish(map[string]interface{}{"type": "started"})
 
 	client := NewCouchDBClient(creds.CouchURL, creds.CouchDB, creds.CouchLogin, creds.CouchToken)
 
-	data, err := client.FetchBBData(ctx)
+	since, err := s.db.GetSyncState(ctx, creds.ID)
 	if err != nil {
-		log.Printf("Failed to fetch data: %v", err)
-		return
+		log.Printf("Failed to load sync state for %s: %v", creds.Email, err)
+		err = fmt.Errorf("load sync state: %w", err)
+		s.syncEvents.Publish(map[string]interface{}{"type": "error", "message": err.Error()})
+		return 0, err
+	}
+
+	data, newSeq, err := client.FetchBBData(ctx, since)
+	if errors.Is(err, errSequenceInvalidated) {
+		log.Printf("Sync sequence invalidated for %s, falling back to full resync", creds.Email)
+		data, newSeq, err = client.FetchBBData(ctx, "")
+	}
+	if err != nil {
+		log.Printf("Failed to fetch data for %s: %v", creds.Email, err)
+		err = fmt.Errorf("fetch data: %w", err)
+		s.syncEvents.Publish(map[string]interface{}{"type": "error", "message": err.Error()})
+		return 0, err
 	}
 
-	balances := data.CalculateAccountBalances()
+	accountDBIDs := make(map[string]int64, len(data.Accounts))
+	currencyByBBID := make(map[string]string, len(data.Accounts))
 
-	for _, acc := range data.Accounts {
-		balance := balances[acc.ID]
+	for i, acc := range data.Accounts {
 		var currCode *string
 		if acc.CurrencyCode != "" {
 			currCode = &acc.CurrencyCode
 		}
 
-		dbAcc, err := s.db.UpsertAccount(ctx, creds.ID, acc.ID, acc.Name, currCode, balance, acc.ExcludeFromStats, acc.Archived)
+		dbAcc, err := s.db.UpsertAccount(ctx, creds.ID, acc.ID, acc.Name, currCode, acc.ExcludeFromStats, acc.Archived)
 		if err != nil {
 			log.Printf("Failed to upsert account %s: %v", acc.Name, err)
 			continue
 		}
+		accountDBIDs[acc.ID] = dbAcc.ID
+		currencyByBBID[acc.ID] = acc.CurrencyCode
+		s.notifyWebhooks("account_synced", map[string]interface{}{
+			"accountId": dbAcc.ID,
+			"name":      dbAcc.Name,
+		})
+		s.syncEvents.Publish(map[string]interface{}{
+			"type":  "account",
+			"name":  acc.Name,
+			"index": i + 1,
+			"total": len(data.Accounts),
+		})
+	}
 
-		balanceUSD := convertToUSD(balance, acc.CurrencyCode)
-		if err := s.db.InsertBalanceHistory(ctx, dbAcc.ID, balance, &balanceUSD); err != nil {
-			log.Printf("Failed to insert balance history for %s: %v", acc.Name, err)
+	touched := s.syncLedger(ctx, creds, data, accountDBIDs, currencyByBBID)
+	for accountID, currencyCode := range touched {
+		s.refreshAccountSnapshot(ctx, accountID, currencyCode)
+	}
+
+	if err := s.db.UpsertSyncState(ctx, creds.ID, newSeq); err != nil {
+		log.Printf("Failed to persist sync state for %s: %v", creds.Email, err)
+	}
+
+	log.Printf("Sync completed for %s: %d accounts, %d accounts with balance changes", creds.Email, len(data.Accounts), len(touched))
+	s.syncEvents.Publish(map[string]interface{}{"type": "completed", "accounts": len(data.Accounts)})
+	return len(data.Accounts), nil
+}
+
+// syncLedger books postings for new records and reversals for deleted ones,
+// returning every account whose balance may have changed so the caller can
+// refresh its snapshot. Records whose account wasn't part of this batch
+// (the common case on an incremental sync) are resolved against accounts
+// already on file.
+func (s *server) syncLedger(ctx context.Context, creds *Credentials, data *BBData, accountDBIDs map[string]int64, currencyByBBID map[string]string) map[int64]string {
+	touched := make(map[int64]string)
+
+	resolveAccount := func(bbAccountID string) (int64, string, bool) {
+		if id, ok := accountDBIDs[bbAccountID]; ok {
+			return id, currencyByBBID[bbAccountID], true
 		}
+		id, currencyCode, ok, err := s.db.GetAccountIDByBBID(ctx, creds.ID, bbAccountID)
+		if err != nil {
+			log.Printf("Failed to resolve account %s: %v", bbAccountID, err)
+			return 0, "", false
+		}
+		return id, currencyCode, ok
+	}
+
+	seen, err := s.db.ListTransactionExternalIDs(ctx, creds.ID)
+	if err != nil {
+		log.Printf("Failed to load existing transaction ids: %v", err)
+		return touched
 	}
 
-	log.Printf("Sync completed for %s: %d accounts", creds.Email, len(data.Accounts))
+	for _, acc := range data.Accounts {
+		openingID := acc.ID + ":init"
+		if seen[openingID] {
+			continue
+		}
+		accountDBID, ok := accountDBIDs[acc.ID]
+		if !ok {
+			continue
+		}
+		txn, postings := openingBalanceTransaction(creds.ID, accountDBID, openingID, acc.InitAmountCents, currencyByBBID[acc.ID])
+		if err := s.db.InsertTransaction(ctx, txn, postings); err != nil {
+			log.Printf("Failed to insert opening balance for account %s: %v", acc.Name, err)
+			continue
+		}
+		touched[accountDBID] = currencyByBBID[acc.ID]
+	}
+
+	imported := 0
+	for _, rec := range data.Records {
+		if seen[rec.ID] {
+			continue
+		}
+		accountDBID, currencyCode, ok := resolveAccount(rec.AccountID)
+		if !ok {
+			continue
+		}
+
+		txn, postings := recordToTransaction(creds.ID, accountDBID, rec, currencyCode)
+		if err := s.db.InsertTransaction(ctx, txn, postings); err != nil {
+			log.Printf("Failed to insert transaction %s: %v", rec.ID, err)
+			continue
+		}
+		touched[accountDBID] = currencyCode
+		imported++
+
+		if !rec.IsTransfer {
+			s.recordExternalFlow(ctx, accountDBID, rec, currencyCode)
+		}
+	}
+	if imported > 0 {
+		log.Printf("Imported %d new ledger transactions for %s", imported, creds.Email)
+	}
+
+	reversed := 0
+	for _, deletedID := range data.DeletedRecords {
+		accounts, ok, err := s.db.ReverseTransaction(ctx, creds.ID, deletedID)
+		if err != nil {
+			log.Printf("Failed to reverse transaction %s: %v", deletedID, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		for accountID, currencyCode := range accounts {
+			touched[accountID] = currencyCode
+		}
+		reversed++
+	}
+	if reversed > 0 {
+		log.Printf("Reversed %d deleted ledger transactions for %s", reversed, creds.Email)
+	}
+
+	return touched
+}
+
+// recordExternalFlow persists a BudgetBakers record as a deposit or
+// withdrawal, as distinct from a transfer between the user's own accounts.
+// Type 0 records increase the account balance (money coming in, a deposit);
+// type 1 records decrease it (money going out, a withdrawal) — the same
+// convention recordToTransaction uses to sign the ledger posting.
+func (s *server) recordExternalFlow(ctx context.Context, accountDBID int64, rec BBRecord, currencyCode string) {
+	var currCode *string
+	if currencyCode != "" {
+		currCode = &currencyCode
+	}
+	amountUSD := s.convertToUSD(ctx, rec.AmountCents, currencyCode, rec.RecordDate)
+
+	var err error
+	if rec.Type == 0 {
+		err = s.db.InsertDeposit(ctx, accountDBID, rec.AmountCents, currCode, &amountUSD, rec.RecordDate, rec.ID)
+	} else {
+		err = s.db.InsertWithdrawal(ctx, accountDBID, rec.AmountCents, currCode, &amountUSD, rec.RecordDate, rec.ID)
+	}
+	if err != nil {
+		log.Printf("Failed to record external flow for %s: %v", rec.ID, err)
+	}
+}
+
+// refreshAccountSnapshot recomputes an account's balance from the ledger and
+// persists both the accounts.balance_cents cache and a balance_history point,
+// so downstream reads (totals, charts) don't need to sum postings live.
+func (s *server) refreshAccountSnapshot(ctx context.Context, accountID int64, currencyCode string) {
+	balance, err := s.db.GetAccountLedgerBalanceCents(ctx, accountID)
+	if err != nil {
+		log.Printf("Failed to compute ledger balance for account %d: %v", accountID, err)
+		return
+	}
+
+	if err := s.db.UpdateAccountBalance(ctx, accountID, balance); err != nil {
+		log.Printf("Failed to update balance for account %d: %v", accountID, err)
+		return
+	}
+
+	recordedAt := time.Now().UTC()
+	balanceUSD := s.convertToUSD(ctx, balance, currencyCode, recordedAt)
+	if _, err := s.db.InsertBalanceHistory(ctx, accountID, balance, &balanceUSD, "sync", nil, recordedAt); err != nil {
+		log.Printf("Failed to insert balance history for account %d: %v", accountID, err)
+		return
+	}
+
+	s.notifyWebhooks("balance_history_inserted", map[string]interface{}{
+		"accountId":    accountID,
+		"balanceCents": balance,
+		"balanceUsd":   balanceUSD,
+	})
 }
 
 func (s *server) handleGetAccountHistory(w http.ResponseWriter, r *http.Request) {
@@ -232,7 +424,7 @@ func (s *server) handleGetAccountHistory(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	acc, err := s.db.GetAccountByID(r.Context(), id)
+	acc, err := s.db.GetAccountByIDForUser(r.Context(), id, userFromContext(r.Context()).ID)
 	if err != nil {
 		log.Printf("Failed to get account: %v", err)
 		writeError(w, http.StatusInternalServerError, "failed to get account")
@@ -274,12 +466,144 @@ func (s *server) handleGetAccountHistory(w http.ResponseWriter, r *http.Request)
 	})
 }
 
+func (s *server) handleListAccountTransactions(w http.ResponseWriter, r *http.Request) {
+	idParam := chi.URLParam(r, "id")
+	id, err := strconv.ParseInt(idParam, 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid account id")
+		return
+	}
+
+	acc, err := s.db.GetAccountByIDForUser(r.Context(), id, userFromContext(r.Context()).ID)
+	if err != nil {
+		log.Printf("Failed to get account: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to get account")
+		return
+	}
+	if acc == nil {
+		writeError(w, http.StatusNotFound, "account not found")
+		return
+	}
+
+	var from, to *time.Time
+	if fromStr := r.URL.Query().Get("from"); fromStr != "" {
+		if parsed, err := time.Parse(time.RFC3339, fromStr); err == nil {
+			from = &parsed
+		}
+	}
+	if toStr := r.URL.Query().Get("to"); toStr != "" {
+		if parsed, err := time.Parse(time.RFC3339, toStr); err == nil {
+			to = &parsed
+		}
+	}
+
+	txns, err := s.db.ListAccountTransactions(r.Context(), id, from, to)
+	if err != nil {
+		log.Printf("Failed to list transactions: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to list transactions")
+		return
+	}
+	if txns == nil {
+		txns = []TransactionView{}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"accountId":    id,
+		"transactions": txns,
+	})
+}
+
+func (s *server) handleListAccountFlows(w http.ResponseWriter, r *http.Request) {
+	idParam := chi.URLParam(r, "id")
+	id, err := strconv.ParseInt(idParam, 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid account id")
+		return
+	}
+
+	acc, err := s.db.GetAccountByIDForUser(r.Context(), id, userFromContext(r.Context()).ID)
+	if err != nil {
+		log.Printf("Failed to get account: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to get account")
+		return
+	}
+	if acc == nil {
+		writeError(w, http.StatusNotFound, "account not found")
+		return
+	}
+
+	var from, to *time.Time
+	if fromStr := r.URL.Query().Get("from"); fromStr != "" {
+		if parsed, err := time.Parse(time.RFC3339, fromStr); err == nil {
+			from = &parsed
+		}
+	}
+	if toStr := r.URL.Query().Get("to"); toStr != "" {
+		if parsed, err := time.Parse(time.RFC3339, toStr); err == nil {
+			to = &parsed
+		}
+	}
+
+	limit := 50
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		if parsed, err := strconv.Atoi(limitStr); err == nil && parsed > 0 && parsed <= 500 {
+			limit = parsed
+		}
+	}
+	offset := 0
+	if offsetStr := r.URL.Query().Get("offset"); offsetStr != "" {
+		if parsed, err := strconv.Atoi(offsetStr); err == nil && parsed >= 0 {
+			offset = parsed
+		}
+	}
+
+	flows, err := s.db.ListAccountFlows(r.Context(), id, from, to, limit, offset)
+	if err != nil {
+		log.Printf("Failed to list flows: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to list flows")
+		return
+	}
+	if flows == nil {
+		flows = []Flow{}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"accountId": id,
+		"flows":     flows,
+		"limit":     limit,
+		"offset":    offset,
+	})
+}
+
+func (s *server) handleGetTransaction(w http.ResponseWriter, r *http.Request) {
+	idParam := chi.URLParam(r, "id")
+	id, err := strconv.ParseInt(idParam, 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid transaction id")
+		return
+	}
+
+	txn, err := s.db.GetTransactionByIDForUser(r.Context(), id, userFromContext(r.Context()).ID)
+	if err != nil {
+		log.Printf("Failed to get transaction: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to get transaction")
+		return
+	}
+	if txn == nil {
+		writeError(w, http.StatusNotFound, "transaction not found")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, txn)
+}
+
 func (s *server) handleGetTotalBalance(w http.ResponseWriter, r *http.Request) {
-	creds, err := s.db.GetCredentials(r.Context())
+	creds, err := s.db.GetCredentialsForUser(r.Context(), userFromContext(r.Context()).ID)
 	if err != nil || creds == nil {
 		writeJSON(w, http.StatusOK, map[string]interface{}{
-			"totalUsd":  0,
-			"connected": false,
+			"totalUsd":         0,
+			"netContributions": 0,
+			"connected":        false,
 		})
 		return
 	}
@@ -291,12 +615,26 @@ func (s *server) handleGetTotalBalance(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	netContributions, err := s.db.GetNetContributions(r.Context(), creds.ID)
+	if err != nil {
+		log.Printf("Failed to get net contributions: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to get balance")
+		return
+	}
+
 	writeJSON(w, http.StatusOK, map[string]interface{}{
-		"totalUsd":  total,
-		"connected": true,
+		"totalUsd":         total,
+		"netContributions": netContributions,
+		"connected":        true,
 	})
 }
 
+// handleGetScript returns the bookmarklet that scrapes CouchDB replication
+// credentials out of the BudgetBakers web app's console.
+//
+// Deprecated: superseded by the OAuth 2.0 flow in oauth.go
+// (/api/oauth/budgetbakers/login). Kept as a fallback for BB_OAUTH_CLIENT_ID
+// deployments that haven't registered an OAuth app yet.
 func (s *server) handleGetScript(w http.ResponseWriter, r *http.Request) {
 	script := `(async () => {
   try {
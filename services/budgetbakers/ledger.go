@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+//go:embed migrations/0004_ledger.sql
+var ledgerMigrationSQL string
+
+func init() {
+	registerSQLMigration(4, "ledger", ledgerMigrationSQL)
+	registerMigration(Migration{
+		Version: 8,
+		Name:    "backfill_account_balances",
+		Up:      backfillAccountBalances,
+		Down: func(ctx context.Context, tx pgx.Tx) error {
+			// balance_cents is fully derived from the ledger, so there's
+			// nothing meaningful to restore — the safe down is a no-op.
+			return nil
+		},
+	})
+}
+
+// backfillAccountBalances recomputes every account's balance_cents from its
+// ledger postings. It exists because the switch to ledger-derived balances
+// stopped writing balance_cents at sync time in favor of recomputing it via
+// refreshAccountSnapshot on each sync — any account that hadn't synced since
+// then would otherwise keep carrying its last pre-ledger value. Unlike the
+// migrations above, this needs one query and one UPDATE per account rather
+// than a single statement, so it's registered as a Go migration.
+func backfillAccountBalances(ctx context.Context, tx pgx.Tx) error {
+	rows, err := tx.Query(ctx, `SELECT id FROM accounts`)
+	if err != nil {
+		return err
+	}
+	var accountIDs []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		accountIDs = append(accountIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range accountIDs {
+		var balance int64
+		if err := tx.QueryRow(ctx, `SELECT COALESCE(SUM(amount_cents), 0) FROM postings WHERE account_id = $1`, id).Scan(&balance); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `UPDATE accounts SET balance_cents = $1 WHERE id = $2`, balance, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Transaction is a ledger entry: a single economic event backed by one or
+// more balanced Postings. ExternalID carries the BudgetBakers record ID so
+// re-syncing the same CouchDB history is idempotent.
+type Transaction struct {
+	ID           int64     `json:"id"`
+	CredentialID int64     `json:"credentialId"`
+	OccurredAt   time.Time `json:"occurredAt"`
+	ExternalID   *string   `json:"externalId,omitempty"`
+	Description  *string   `json:"description,omitempty"`
+}
+
+// Posting is one leg of a Transaction. AccountID is nil for the
+// counterparty leg of a record (money entering or leaving outside the
+// tracked accounts), so every transaction's postings still sum to zero.
+type Posting struct {
+	ID           int64  `json:"id"`
+	AccountID    *int64 `json:"accountId,omitempty"`
+	AmountCents  int64  `json:"amountCents"`
+	CurrencyCode string `json:"currencyCode"`
+}
+
+type TransactionView struct {
+	Transaction
+	Postings []Posting `json:"postings"`
+}
+
+// InsertTransaction inserts a transaction and its postings atomically so the
+// deferred postings_balanced trigger validates the whole set at commit. If a
+// transaction with the same (credential_id, external_id) already exists, the
+// insert is a no-op — this is what makes re-syncing idempotent.
+func (db *DB) InsertTransaction(ctx context.Context, txn Transaction, postings []Posting) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	pgTx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer pgTx.Rollback(ctx)
+
+	var txnID int64
+	err = pgTx.QueryRow(ctx, `
+		INSERT INTO transactions (credential_id, occurred_at, external_id, description)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (credential_id, external_id) DO NOTHING
+		RETURNING id
+	`, txn.CredentialID, txn.OccurredAt, txn.ExternalID, txn.Description).Scan(&txnID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, p := range postings {
+		if _, err := pgTx.Exec(ctx, `
+			INSERT INTO postings (transaction_id, account_id, amount_cents, currency_code)
+			VALUES ($1, $2, $3, $4)
+		`, txnID, p.AccountID, p.AmountCents, p.CurrencyCode); err != nil {
+			return err
+		}
+	}
+
+	return pgTx.Commit(ctx)
+}
+
+// ReverseTransaction books a new transaction that negates every posting of
+// the one imported under externalID, tagged externalID+":reversal". This is
+// how a deleted BudgetBakers record is handled: rather than deleting or
+// mutating the original transaction, a reversing entry is inserted so the
+// ledger's history — and the zero-sum invariant it depends on — stays
+// append-only. Returns ok=false if the original transaction isn't on file
+// (e.g. it was never synced, or was already reversed).
+func (db *DB) ReverseTransaction(ctx context.Context, credID int64, externalID string) (touchedAccounts map[int64]string, ok bool, err error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	reversalID := externalID + ":reversal"
+
+	var alreadyReversed bool
+	if err := db.Pool.QueryRow(ctx, `
+		SELECT EXISTS (SELECT 1 FROM transactions WHERE credential_id = $1 AND external_id = $2)
+	`, credID, reversalID).Scan(&alreadyReversed); err != nil {
+		return nil, false, err
+	}
+	if alreadyReversed {
+		return nil, false, nil
+	}
+
+	var txnID int64
+	var occurredAt time.Time
+	err = db.Pool.QueryRow(ctx, `
+		SELECT id, occurred_at FROM transactions WHERE credential_id = $1 AND external_id = $2
+	`, credID, externalID).Scan(&txnID, &occurredAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	rows, err := db.Pool.Query(ctx, `
+		SELECT account_id, amount_cents, currency_code FROM postings WHERE transaction_id = $1
+	`, txnID)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	var postings []Posting
+	touchedAccounts = make(map[int64]string)
+	for rows.Next() {
+		var p Posting
+		if err := rows.Scan(&p.AccountID, &p.AmountCents, &p.CurrencyCode); err != nil {
+			return nil, false, err
+		}
+		postings = append(postings, Posting{AccountID: p.AccountID, AmountCents: -p.AmountCents, CurrencyCode: p.CurrencyCode})
+		if p.AccountID != nil {
+			touchedAccounts[*p.AccountID] = p.CurrencyCode
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	reversal := Transaction{
+		CredentialID: credID,
+		OccurredAt:   occurredAt,
+		ExternalID:   &reversalID,
+	}
+	if err := db.InsertTransaction(ctx, reversal, postings); err != nil {
+		return nil, false, err
+	}
+
+	return touchedAccounts, true, nil
+}
+
+// ListTransactionExternalIDs returns the external_ids already imported for a
+// credential, so the sync pipeline can diff the remote record set instead of
+// re-inserting history it already has.
+func (db *DB) ListTransactionExternalIDs(ctx context.Context, credID int64) (map[string]bool, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.Pool.Query(ctx, `
+		SELECT external_id FROM transactions WHERE credential_id = $1 AND external_id IS NOT NULL
+	`, credID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	seen := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		seen[id] = true
+	}
+	return seen, rows.Err()
+}
+
+// GetAccountLedgerBalanceCents derives the current balance from postings at
+// query time, rather than trusting a precomputed column.
+func (db *DB) GetAccountLedgerBalanceCents(ctx context.Context, accountID int64) (int64, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	var total int64
+	err := db.Pool.QueryRow(ctx, `
+		SELECT COALESCE(SUM(amount_cents), 0) FROM postings WHERE account_id = $1
+	`, accountID).Scan(&total)
+	return total, err
+}
+
+func (db *DB) ListAccountTransactions(ctx context.Context, accountID int64, from, to *time.Time) ([]TransactionView, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		SELECT DISTINCT t.id, t.credential_id, t.occurred_at, t.external_id, t.description
+		FROM transactions t
+		JOIN postings p ON p.transaction_id = t.id
+		WHERE p.account_id = $1
+	`
+	args := []interface{}{accountID}
+	if from != nil {
+		args = append(args, *from)
+		query += fmt.Sprintf(" AND t.occurred_at >= $%d", len(args))
+	}
+	if to != nil {
+		args = append(args, *to)
+		query += fmt.Sprintf(" AND t.occurred_at <= $%d", len(args))
+	}
+	query += " ORDER BY t.occurred_at ASC"
+
+	rows, err := db.Pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var txns []TransactionView
+	for rows.Next() {
+		var t TransactionView
+		if err := rows.Scan(&t.ID, &t.CredentialID, &t.OccurredAt, &t.ExternalID, &t.Description); err != nil {
+			return nil, err
+		}
+		txns = append(txns, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(txns) == 0 {
+		return txns, nil
+	}
+
+	ids := make([]int64, len(txns))
+	byID := make(map[int64]*TransactionView, len(txns))
+	for i := range txns {
+		ids[i] = txns[i].ID
+		byID[txns[i].ID] = &txns[i]
+	}
+
+	postingRows, err := db.Pool.Query(ctx, `
+		SELECT id, transaction_id, account_id, amount_cents, currency_code
+		FROM postings
+		WHERE transaction_id = ANY($1)
+		ORDER BY id ASC
+	`, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer postingRows.Close()
+
+	for postingRows.Next() {
+		var p Posting
+		var txnID int64
+		if err := postingRows.Scan(&p.ID, &txnID, &p.AccountID, &p.AmountCents, &p.CurrencyCode); err != nil {
+			return nil, err
+		}
+		if t, ok := byID[txnID]; ok {
+			t.Postings = append(t.Postings, p)
+		}
+	}
+	return txns, postingRows.Err()
+}
+
+// GetTransactionByIDForUser is GetTransactionByID scoped to transactions
+// whose credential is owned by ownerID.
+func (db *DB) GetTransactionByIDForUser(ctx context.Context, id, ownerID int64) (*TransactionView, error) {
+	txn, err := db.GetTransactionByID(ctx, id)
+	if err != nil || txn == nil {
+		return txn, err
+	}
+
+	var owned bool
+	if err := db.Pool.QueryRow(ctx, `
+		SELECT EXISTS (SELECT 1 FROM credentials WHERE id = $1 AND owner_id = $2)
+	`, txn.CredentialID, ownerID).Scan(&owned); err != nil {
+		return nil, err
+	}
+	if !owned {
+		return nil, nil
+	}
+	return txn, nil
+}
+
+func (db *DB) GetTransactionByID(ctx context.Context, id int64) (*TransactionView, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	var t TransactionView
+	err := db.Pool.QueryRow(ctx, `
+		SELECT id, credential_id, occurred_at, external_id, description FROM transactions WHERE id = $1
+	`, id).Scan(&t.ID, &t.CredentialID, &t.OccurredAt, &t.ExternalID, &t.Description)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	rows, err := db.Pool.Query(ctx, `
+		SELECT id, account_id, amount_cents, currency_code FROM postings WHERE transaction_id = $1 ORDER BY id ASC
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p Posting
+		if err := rows.Scan(&p.ID, &p.AccountID, &p.AmountCents, &p.CurrencyCode); err != nil {
+			return nil, err
+		}
+		t.Postings = append(t.Postings, p)
+	}
+	return &t, rows.Err()
+}
+
+// openingBalanceTransaction books an account's BudgetBakers initAmount as a
+// one-time balanced transaction, tagged externalID (callers pass the
+// account's BB id suffixed with ":init") so it's imported at most once per
+// account, the same idempotency mechanism used for regular records.
+func openingBalanceTransaction(credID, accountDBID int64, externalID string, amountCents int64, currencyCode string) (Transaction, []Posting) {
+	id := externalID
+	txn := Transaction{
+		CredentialID: credID,
+		OccurredAt:   time.Unix(0, 0).UTC(),
+		ExternalID:   &id,
+	}
+	postings := []Posting{
+		{AccountID: &accountDBID, AmountCents: amountCents, CurrencyCode: currencyCode},
+		{AccountID: nil, AmountCents: -amountCents, CurrencyCode: currencyCode},
+	}
+	return txn, postings
+}
+
+// recordToTransaction converts a BudgetBakers ledger record into a balanced
+// Transaction: one posting on the tracked account, offset by a counterparty
+// posting (account_id NULL) representing money entering or leaving the
+// account from outside the system.
+func recordToTransaction(credID, accountDBID int64, rec BBRecord, currencyCode string) (Transaction, []Posting) {
+	amount := rec.AmountCents
+	if rec.Type == 1 {
+		amount = -amount
+	}
+
+	externalID := rec.ID
+	txn := Transaction{
+		CredentialID: credID,
+		OccurredAt:   rec.RecordDate,
+		ExternalID:   &externalID,
+	}
+	postings := []Posting{
+		{AccountID: &accountDBID, AmountCents: amount, CurrencyCode: currencyCode},
+		{AccountID: nil, AmountCents: -amount, CurrencyCode: currencyCode},
+	}
+	return txn, postings
+}
@@ -4,19 +4,28 @@ import (
 	"context"
 	"log"
 	"net/http"
+	"os"
 
 	"github.com/go-chi/chi/v5"
 )
 
 type server struct {
-	env Env
-	db  *DB
+	env        Env
+	db         *DB
+	fx         FXProvider
+	schedules  *syncSchedules
+	syncEvents *syncBroker
 }
 
 func main() {
 	env := loadEnv()
 	ctx := context.Background()
 
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrateCLI(env, os.Args[2:])
+		return
+	}
+
 	db, err := initDB(ctx, env)
 	if err != nil {
 		log.Fatalf("Failed to init DB: %v", err)
@@ -24,9 +33,22 @@ func main() {
 	defer db.Close()
 
 	s := &server{
-		env: env,
-		db:  db,
+		env:        env,
+		db:         db,
+		schedules:  newSyncSchedules(),
+		syncEvents: newSyncBroker(),
+	}
+	switch env.FXProvider {
+	case "ecb":
+		s.fx = NewECBProvider(db)
+	case "exchangerate-host":
+		s.fx = NewExchangeRateHostProvider(db)
+	default:
+		s.fx = StaticProvider{}
 	}
+	s.startFXRefresh()
+	s.startOAuthRefresh()
+	s.startScheduler()
 
 	router := chi.NewRouter()
 	router.Use(s.corsMiddleware)
@@ -35,15 +57,40 @@ func main() {
 	router.Get("/health", s.handleHealth)
 
 	router.Route("/api", func(r chi.Router) {
-		r.Get("/credentials", s.handleGetCredentials)
-		r.Post("/credentials", s.handleSaveCredentials)
-		r.Delete("/credentials", s.handleDeleteCredentials)
-		r.Get("/accounts", s.handleListAccounts)
-		r.Put("/accounts/{id}", s.handleUpdateAccount)
-		r.Get("/accounts/{id}/history", s.handleGetAccountHistory)
-		r.Post("/sync", s.handleSync)
-		r.Get("/balance", s.handleGetTotalBalance)
-		r.Get("/script", s.handleGetScript)
+		r.Post("/auth/register", s.handleRegister)
+		r.Post("/auth/login", s.handleLogin)
+		r.Post("/auth/logout", s.handleLogout)
+		r.Get("/script", s.handleGetScript) // deprecated: use /oauth/budgetbakers/login
+
+		r.Group(func(r chi.Router) {
+			r.Use(s.requireAuth)
+
+			r.Get("/credentials", s.handleGetCredentials)
+			r.Post("/credentials", s.handleSaveCredentials)
+			r.Delete("/credentials", s.handleDeleteCredentials)
+			r.Get("/accounts", s.handleListAccounts)
+			r.Put("/accounts/{id}", s.handleUpdateAccount)
+			r.Get("/accounts/{id}/history", s.handleGetAccountHistory)
+			r.Get("/accounts/{id}/transactions", s.handleListAccountTransactions)
+			r.Get("/transactions/{id}", s.handleGetTransaction)
+			r.Get("/accounts/{id}/flows", s.handleListAccountFlows)
+			r.Post("/accounts/{id}/adjust", s.handleAdjustBalance)
+			r.Get("/accounts/{id}/adjustments", s.handleListAdjustments)
+			r.Patch("/adjustments/{id}", s.handlePatchAdjustment)
+			r.Post("/sync", s.handleSync)
+			r.Get("/sync/stream", s.handleSyncStream)
+			r.Put("/sync/schedule", s.handleUpdateSyncSchedule)
+			r.Get("/sync/runs", s.handleListSyncRuns)
+			r.Get("/balance", s.handleGetTotalBalance)
+			r.Get("/oauth/budgetbakers/login", s.handleOAuthLogin)
+			r.Get("/oauth/budgetbakers/callback", s.handleOAuthCallback)
+			r.Post("/webhooks", s.handleCreateWebhook)
+			r.Get("/webhooks", s.handleListWebhooks)
+			r.Delete("/webhooks/{id}", s.handleDeleteWebhook)
+			r.Get("/webhooks/{id}/deliveries", s.handleListWebhookDeliveries)
+			r.Get("/fx/rates", s.handleGetFXRates)
+			r.Post("/rates/rebuild", s.handleRebuildRates)
+		})
 	})
 
 	addr := ":" + env.Port
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Migration is one unit of schema evolution. Most are SQL-backed (see
+// registerSQLMigration), but Up/Down can run arbitrary Go against the
+// transaction too — e.g. a one-off data backfill that needs real control
+// flow rather than a single statement.
+//
+// Migrations are owned by the domain module they belong to (webhooks.go
+// registers the webhooks migration, ledger.go registers the ledger ones,
+// and so on) rather than living as anonymous files in a shared directory.
+// Each domain's init() calls registerMigration/registerSQLMigration, and
+// migrationRegistry is the single ordered list applyMigrations walks — so
+// the schema stays one `_migrations`-tracked history even as ownership of
+// it is spread across the package.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      func(ctx context.Context, tx pgx.Tx) error
+	Down    func(ctx context.Context, tx pgx.Tx) error
+
+	// checksum and downSQL are only populated for SQL-backed migrations.
+	// checksum guards against a migration's source changing after it was
+	// applied; downSQL is persisted into _migrations so `migrate down` can
+	// roll back using the SQL text on file even if a later binary no longer
+	// registers that migration. Go-backed migrations leave both blank —
+	// there's no stable source text to hash, and rolling one back requires
+	// the Down func to still be registered in the running binary.
+	checksum string
+	downSQL  string
+}
+
+var migrationRegistry []Migration
+
+// registerMigration adds m to migrationRegistry. Called from each domain
+// file's init(); registration order doesn't matter because every reader
+// sorts by Version (see orderedMigrations).
+func registerMigration(m Migration) {
+	migrationRegistry = append(migrationRegistry, m)
+}
+
+// registerSQLMigration registers a SQL-backed migration from a go:embed'd
+// file using the "-- +up" / "-- +down" directive convention (the same one
+// rockhopper uses).
+func registerSQLMigration(version int64, name, source string) {
+	up, down, err := splitMigration(source)
+	if err != nil {
+		panic(fmt.Sprintf("migration %d (%s): %v", version, name, err))
+	}
+
+	sum := sha256.Sum256([]byte(source))
+	registerMigration(Migration{
+		Version: version,
+		Name:    name,
+		Up: func(ctx context.Context, tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, up)
+			return err
+		},
+		Down: func(ctx context.Context, tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, down)
+			return err
+		},
+		checksum: hex.EncodeToString(sum[:]),
+		downSQL:  down,
+	})
+}
+
+// splitMigration pulls the "-- +up" / "-- +down" sections out of a migration
+// file, following the directive convention used by tools like rockhopper.
+func splitMigration(source string) (up, down string, err error) {
+	upIdx := strings.Index(source, "-- +up")
+	downIdx := strings.Index(source, "-- +down")
+	if upIdx == -1 || downIdx == -1 {
+		return "", "", errors.New("migration missing -- +up / -- +down markers")
+	}
+	if downIdx < upIdx {
+		return "", "", errors.New("-- +down must follow -- +up")
+	}
+
+	up = strings.TrimSpace(source[upIdx+len("-- +up") : downIdx])
+	down = strings.TrimSpace(source[downIdx+len("-- +down"):])
+	return up, down, nil
+}
+
+// orderedMigrations returns every registered migration sorted by version,
+// independent of the order domain modules happened to register them in.
+func orderedMigrations() []Migration {
+	sorted := make([]Migration, len(migrationRegistry))
+	copy(sorted, migrationRegistry)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+	return sorted
+}
+
+func migrationsByVersion() map[int64]Migration {
+	byVersion := make(map[int64]Migration, len(migrationRegistry))
+	for _, m := range migrationRegistry {
+		byVersion[m.Version] = m
+	}
+	return byVersion
+}
+
+// migrationAdvisoryLockKey is an arbitrary constant that applyMigrations (the
+// startup run) locks on, so two pods starting at once serialize on it instead
+// of racing to apply the same version twice. The migrate CLI subcommands do
+// not take this lock.
+const migrationAdvisoryLockKey = 72176_01
+
+func (db *DB) applyMigrations(ctx context.Context) error {
+	migrations := orderedMigrations()
+	if len(migrations) == 0 {
+		return errors.New("no migrations registered")
+	}
+
+	if _, err := db.Pool.Exec(ctx, `SELECT pg_advisory_lock($1)`, int64(migrationAdvisoryLockKey)); err != nil {
+		return fmt.Errorf("acquire migration lock: %w", err)
+	}
+	defer db.Pool.Exec(ctx, `SELECT pg_advisory_unlock($1)`, int64(migrationAdvisoryLockKey))
+
+	if _, err := db.Pool.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS _migrations (
+			version BIGINT PRIMARY KEY,
+			name TEXT NOT NULL,
+			checksum TEXT NOT NULL,
+			down_sql TEXT NOT NULL DEFAULT '',
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+	`); err != nil {
+		return fmt.Errorf("create _migrations: %w", err)
+	}
+	if _, err := db.Pool.Exec(ctx, `ALTER TABLE _migrations ADD COLUMN IF NOT EXISTS down_sql TEXT NOT NULL DEFAULT ''`); err != nil {
+		return fmt.Errorf("add down_sql to _migrations: %w", err)
+	}
+
+	for _, m := range migrations {
+		if err := db.applyMigration(ctx, m); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (db *DB) applyMigration(ctx context.Context, m Migration) error {
+	var existingChecksum string
+	err := db.Pool.QueryRow(ctx, `SELECT checksum FROM _migrations WHERE version = $1`, m.Version).Scan(&existingChecksum)
+	if err == nil {
+		if m.checksum != "" && existingChecksum != m.checksum {
+			return fmt.Errorf("migration %d (%s) was modified after being applied (checksum mismatch)", m.Version, m.Name)
+		}
+		return nil
+	}
+
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("begin migration %d (%s): %w", m.Version, m.Name, err)
+	}
+
+	if err := m.Up(ctx, tx); err != nil {
+		_ = tx.Rollback(ctx)
+		return fmt.Errorf("exec migration %d (%s): %w", m.Version, m.Name, err)
+	}
+
+	if _, err := tx.Exec(ctx, `
+		INSERT INTO _migrations (version, name, checksum, down_sql) VALUES ($1, $2, $3, $4)
+	`, m.Version, m.Name, m.checksum, m.downSQL); err != nil {
+		_ = tx.Rollback(ctx)
+		return fmt.Errorf("record migration %d (%s): %w", m.Version, m.Name, err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("commit migration %d (%s): %w", m.Version, m.Name, err)
+	}
+
+	log.Printf("Applied migration %d (%s)", m.Version, m.Name)
+	return nil
+}
+
+// MigrationStatus is one registered migration's applied/pending state, for a
+// future admin endpoint as well as the `migrate status` CLI subcommand.
+type MigrationStatus struct {
+	Version   int64
+	Name      string
+	Applied   bool
+	AppliedAt string
+}
+
+// MigrationStatus returns every registered migration alongside whether (and
+// when) it has been applied to this database.
+func (db *DB) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	migrations := orderedMigrations()
+
+	rows, err := db.Pool.Query(ctx, `SELECT version, applied_at FROM _migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int64]string)
+	for rows.Next() {
+		var version int64
+		var appliedAt string
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var statuses []MigrationStatus
+	for _, m := range migrations {
+		appliedAt, ok := applied[m.Version]
+		statuses = append(statuses, MigrationStatus{Version: m.Version, Name: m.Name, Applied: ok, AppliedAt: appliedAt})
+	}
+	return statuses, nil
+}
+
+func (db *DB) migrateUpTo(ctx context.Context, toVersion int64) error {
+	for _, m := range orderedMigrations() {
+		if toVersion > 0 && m.Version > toVersion {
+			break
+		}
+		if err := db.applyMigration(ctx, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *DB) migrateDownTo(ctx context.Context, toVersion int64) error {
+	byVersion := migrationsByVersion()
+
+	rows, err := db.Pool.Query(ctx, `SELECT version FROM _migrations WHERE version > $1 ORDER BY version DESC`, toVersion)
+	if err != nil {
+		return err
+	}
+	var toRevert []int64
+	for rows.Next() {
+		var version int64
+		if err := rows.Scan(&version); err != nil {
+			rows.Close()
+			return err
+		}
+		toRevert = append(toRevert, version)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, version := range toRevert {
+		m, ok := byVersion[version]
+		if !ok {
+			return fmt.Errorf("cannot roll back version %d: migration no longer registered", version)
+		}
+
+		tx, err := db.Pool.Begin(ctx)
+		if err != nil {
+			return fmt.Errorf("begin rollback of %s: %w", m.Name, err)
+		}
+		if err := m.Down(ctx, tx); err != nil {
+			_ = tx.Rollback(ctx)
+			return fmt.Errorf("exec down migration %s: %w", m.Name, err)
+		}
+		if _, err := tx.Exec(ctx, `DELETE FROM _migrations WHERE version = $1`, version); err != nil {
+			_ = tx.Rollback(ctx)
+			return fmt.Errorf("unrecord migration %s: %w", m.Name, err)
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return fmt.Errorf("commit rollback of %s: %w", m.Name, err)
+		}
+		log.Printf("Reverted migration %d (%s)", version, m.Name)
+	}
+
+	return nil
+}
+
+// Rollback reverts the last `steps` applied migrations, preferring the down
+// SQL stored in _migrations at apply time over re-running a registered
+// migration's Down func — which is what makes `migrate down <n>` safe to run
+// against an older binary image that may not carry the original migration
+// anymore. Go-backed migrations have no stored SQL, so rolling one back
+// requires its Down func to still be registered in the running binary.
+func (db *DB) Rollback(ctx context.Context, steps int) error {
+	if steps <= 0 {
+		return fmt.Errorf("steps must be positive, got %d", steps)
+	}
+
+	rows, err := db.Pool.Query(ctx, `
+		SELECT version, name, down_sql FROM _migrations ORDER BY version DESC LIMIT $1
+	`, steps)
+	if err != nil {
+		return err
+	}
+
+	type appliedMigration struct {
+		Version int64
+		Name    string
+		DownSQL string
+	}
+	var toRevert []appliedMigration
+	for rows.Next() {
+		var m appliedMigration
+		if err := rows.Scan(&m.Version, &m.Name, &m.DownSQL); err != nil {
+			rows.Close()
+			return err
+		}
+		toRevert = append(toRevert, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	byVersion := migrationsByVersion()
+
+	for _, m := range toRevert {
+		tx, err := db.Pool.Begin(ctx)
+		if err != nil {
+			return fmt.Errorf("begin rollback of %s: %w", m.Name, err)
+		}
+
+		if strings.TrimSpace(m.DownSQL) != "" {
+			if _, err := tx.Exec(ctx, m.DownSQL); err != nil {
+				_ = tx.Rollback(ctx)
+				return fmt.Errorf("exec down migration %s: %w", m.Name, err)
+			}
+		} else {
+			reg, ok := byVersion[m.Version]
+			if !ok || reg.Down == nil {
+				_ = tx.Rollback(ctx)
+				return fmt.Errorf("migration %d (%s) has no down migration available", m.Version, m.Name)
+			}
+			if err := reg.Down(ctx, tx); err != nil {
+				_ = tx.Rollback(ctx)
+				return fmt.Errorf("exec down migration %s: %w", m.Name, err)
+			}
+		}
+
+		if _, err := tx.Exec(ctx, `DELETE FROM _migrations WHERE version = $1`, m.Version); err != nil {
+			_ = tx.Rollback(ctx)
+			return fmt.Errorf("unrecord migration %s: %w", m.Name, err)
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return fmt.Errorf("commit rollback of %s: %w", m.Name, err)
+		}
+		log.Printf("Rolled back migration %d (%s)", m.Version, m.Name)
+	}
+
+	return nil
+}
+
+// runMigrateCLI implements `<binary> migrate up|up-to <v>|down [steps]|down-to <v>|status`,
+// reusing the same DB code paths as the HTTP server's automatic migration run.
+func runMigrateCLI(env Env, args []string) {
+	if len(args) == 0 {
+		log.Fatal("usage: migrate <up|up-to|down|down-to|status> [version]")
+	}
+
+	ctx := context.Background()
+	pool, err := newMigrationPool(ctx, env.DatabaseURL)
+	if err != nil {
+		log.Fatalf("failed to connect: %v", err)
+	}
+	defer pool.Close()
+	db := &DB{Pool: pool}
+
+	switch args[0] {
+	case "up":
+		if err := db.migrateUpTo(ctx, 0); err != nil {
+			log.Fatalf("migrate up failed: %v", err)
+		}
+	case "up-to":
+		version := requireVersionArg(args)
+		if err := db.migrateUpTo(ctx, version); err != nil {
+			log.Fatalf("migrate up-to failed: %v", err)
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			parsed, err := strconv.Atoi(args[1])
+			if err != nil {
+				log.Fatalf("invalid step count %q: %v", args[1], err)
+			}
+			steps = parsed
+		}
+		if err := db.Rollback(ctx, steps); err != nil {
+			log.Fatalf("migrate down failed: %v", err)
+		}
+	case "down-to":
+		version := requireVersionArg(args)
+		if err := db.migrateDownTo(ctx, version); err != nil {
+			log.Fatalf("migrate down-to failed: %v", err)
+		}
+	case "status":
+		statuses, err := db.MigrationStatus(ctx)
+		if err != nil {
+			log.Fatalf("migrate status failed: %v", err)
+		}
+		for _, st := range statuses {
+			state := "pending"
+			if st.Applied {
+				state = "applied at " + st.AppliedAt
+			}
+			fmt.Printf("%d\t%s\t%s\n", st.Version, st.Name, state)
+		}
+	default:
+		log.Fatalf("unknown migrate subcommand %q", args[0])
+	}
+}
+
+func requireVersionArg(args []string) int64 {
+	if len(args) < 2 {
+		log.Fatal("expected a version argument")
+	}
+	version, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		log.Fatalf("invalid version %q: %v", args[1], err)
+	}
+	return version
+}
+
+func newMigrationPool(ctx context.Context, databaseURL string) (*pgxpool.Pool, error) {
+	return pgxpool.New(ctx, databaseURL)
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+//go:embed migrations/0009_oauth_tokens.sql
+var oauthMigrationSQL string
+
+func init() {
+	registerSQLMigration(9, "oauth_tokens", oauthMigrationSQL)
+}
+
+const (
+	bbOAuthAuthorizeURL = "https://app.budgetbakers.com/oauth/authorize"
+	bbOAuthTokenURL     = "https://app.budgetbakers.com/oauth/token"
+	bbTRPCUserURL       = "https://app.budgetbakers.com/api/trpc/user.getUser"
+
+	// oauthStateTTL bounds how long an authorize redirect can sit unused
+	// before its state token is rejected, closing the window for a stolen
+	// state param to be replayed against the callback.
+	oauthStateTTL = 10 * time.Minute
+
+	// oauthRefreshMargin is how long before expiry the refresh loop renews
+	// a token, so a sync that starts just before expiry never races it.
+	oauthRefreshMargin = 5 * time.Minute
+)
+
+// oauthStateEntry remembers which app user kicked off an authorize request,
+// so the callback knows whose credentials row to attach the connected
+// BudgetBakers account to.
+type oauthStateEntry struct {
+	ownerID   int64
+	createdAt time.Time
+}
+
+// oauthStates tracks outstanding authorize requests so the callback can
+// reject forged or replayed state params. In-memory is fine here: a lost
+// state on restart just means the user has to click "connect" again.
+var oauthStates = struct {
+	mu sync.Mutex
+	m  map[string]oauthStateEntry
+}{m: make(map[string]oauthStateEntry)}
+
+type OAuthTokenPair struct {
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
+}
+
+type oauthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	Error        string `json:"error"`
+}
+
+// bbUserTRPCResponse mirrors the batched tRPC envelope the bookmarklet
+// script (see handleGetScript) parses as userData[0].result.data.json.
+type bbUserTRPCResponse []struct {
+	Result struct {
+		Data struct {
+			JSON struct {
+				UserID      string `json:"userId"`
+				Email       string `json:"email"`
+				Replication struct {
+					URL    string `json:"url"`
+					DBName string `json:"dbName"`
+					Login  string `json:"login"`
+					Token  string `json:"token"`
+				} `json:"replication"`
+			} `json:"json"`
+		} `json:"data"`
+	} `json:"result"`
+}
+
+func newOAuthState(ownerID int64) string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	state := fmt.Sprintf("%x", b)
+
+	oauthStates.mu.Lock()
+	oauthStates.m[state] = oauthStateEntry{ownerID: ownerID, createdAt: time.Now()}
+	for s, entry := range oauthStates.m {
+		if time.Since(entry.createdAt) > oauthStateTTL {
+			delete(oauthStates.m, s)
+		}
+	}
+	oauthStates.mu.Unlock()
+
+	return state
+}
+
+func consumeOAuthState(state string) (int64, bool) {
+	oauthStates.mu.Lock()
+	defer oauthStates.mu.Unlock()
+	entry, ok := oauthStates.m[state]
+	if !ok {
+		return 0, false
+	}
+	delete(oauthStates.m, state)
+	return entry.ownerID, time.Since(entry.createdAt) <= oauthStateTTL
+}
+
+func (s *server) oauthRedirectURI() string {
+	return s.env.BaseURL + "/api/oauth/budgetbakers/callback"
+}
+
+// handleOAuthLogin redirects the browser to BudgetBakers' authorization
+// endpoint, replacing the old "paste this bookmarklet into the console"
+// flow with a standard OAuth 2.0 authorization-code dance.
+func (s *server) handleOAuthLogin(w http.ResponseWriter, r *http.Request) {
+	if s.env.BBOAuthClientID == "" {
+		writeError(w, http.StatusNotImplemented, "BB_OAUTH_CLIENT_ID is not configured")
+		return
+	}
+
+	owner := userFromContext(r.Context())
+	values := url.Values{
+		"response_type": {"code"},
+		"client_id":     {s.env.BBOAuthClientID},
+		"redirect_uri":  {s.oauthRedirectURI()},
+		"scope":         {"offline_access replication"},
+		"state":         {newOAuthState(owner.ID)},
+	}
+
+	http.Redirect(w, r, bbOAuthAuthorizeURL+"?"+values.Encode(), http.StatusFound)
+}
+
+// handleOAuthCallback exchanges the authorization code for tokens, calls
+// user.getUser to obtain the CouchDB replication credentials, and persists
+// both via s.db.SaveCredentials and s.db.SaveOAuthTokens.
+func (s *server) handleOAuthCallback(w http.ResponseWriter, r *http.Request) {
+	if errParam := r.URL.Query().Get("error"); errParam != "" {
+		writeError(w, http.StatusBadRequest, "budgetbakers denied authorization: "+errParam)
+		return
+	}
+
+	state := r.URL.Query().Get("state")
+	ownerID, ok := consumeOAuthState(state)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid or expired oauth state")
+		return
+	}
+
+	code := r.URL.Query().Get("code")
+	if code == "" {
+		writeError(w, http.StatusBadRequest, "missing code")
+		return
+	}
+
+	tokens, expiresAt, err := s.exchangeOAuthCode(r.Context(), code)
+	if err != nil {
+		log.Printf("oauth: failed to exchange code: %v", err)
+		writeError(w, http.StatusBadGateway, "failed to exchange authorization code")
+		return
+	}
+
+	creds, err := s.saveOAuthCredentials(r.Context(), ownerID, tokens, expiresAt)
+	if err != nil {
+		log.Printf("oauth: failed to save credentials: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to save credentials")
+		return
+	}
+
+	go s.runTrackedSync(creds)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "ok",
+		"email":   creds.Email,
+		"message": "connected via oauth, syncing accounts...",
+	})
+}
+
+func (s *server) exchangeOAuthCode(ctx context.Context, code string) (OAuthTokenPair, time.Time, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {s.oauthRedirectURI()},
+		"client_id":     {s.env.BBOAuthClientID},
+		"client_secret": {s.env.BBOAuthClientSecret},
+	}
+	return s.requestOAuthToken(ctx, form)
+}
+
+func (s *server) refreshOAuthCode(ctx context.Context, refreshToken string) (OAuthTokenPair, time.Time, error) {
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+		"client_id":     {s.env.BBOAuthClientID},
+		"client_secret": {s.env.BBOAuthClientSecret},
+	}
+	return s.requestOAuthToken(ctx, form)
+}
+
+func (s *server) requestOAuthToken(ctx context.Context, form url.Values) (OAuthTokenPair, time.Time, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, bbOAuthTokenURL, nil)
+	if err != nil {
+		return OAuthTokenPair{}, time.Time{}, err
+	}
+	req.URL.RawQuery = form.Encode()
+
+	client := &http.Client{Timeout: 15 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return OAuthTokenPair{}, time.Time{}, fmt.Errorf("token request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return OAuthTokenPair{}, time.Time{}, fmt.Errorf("read token response: %w", err)
+	}
+
+	var tokenResp oauthTokenResponse
+	if err := json.Unmarshal(body, &tokenResp); err != nil {
+		return OAuthTokenPair{}, time.Time{}, fmt.Errorf("decode token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || tokenResp.Error != "" {
+		return OAuthTokenPair{}, time.Time{}, fmt.Errorf("token endpoint returned %d: %s", resp.StatusCode, tokenResp.Error)
+	}
+
+	expiresIn := tokenResp.ExpiresIn
+	if expiresIn <= 0 {
+		expiresIn = 3600
+	}
+
+	return OAuthTokenPair{
+		AccessToken:  tokenResp.AccessToken,
+		RefreshToken: tokenResp.RefreshToken,
+	}, time.Now().Add(time.Duration(expiresIn) * time.Second), nil
+}
+
+// fetchReplicationCredentials calls the same user.getUser tRPC endpoint the
+// bookmarklet script (handleGetScript) scrapes from the browser console,
+// but server-side and authenticated with the OAuth access token instead of
+// a session cookie.
+func (s *server) fetchReplicationCredentials(ctx context.Context, accessToken string) (*bbUserTRPCResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, bbTRPCUserURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	q := req.URL.Query()
+	q.Set("batch", "1")
+	q.Set("input", `{"0":{"json":null,"meta":{"values":["undefined"]}}}`)
+	req.URL.RawQuery = q.Encode()
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	client := &http.Client{Timeout: 15 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("user.getUser request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("user.getUser returned %d: %s", resp.StatusCode, string(body))
+	}
+
+	var user bbUserTRPCResponse
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		return nil, fmt.Errorf("decode user.getUser response: %w", err)
+	}
+	if len(user) == 0 || user[0].Result.Data.JSON.Replication.URL == "" {
+		return nil, errors.New("user.getUser response had no replication credentials")
+	}
+	return &user, nil
+}
+
+func (s *server) saveOAuthCredentials(ctx context.Context, ownerID int64, tokens OAuthTokenPair, expiresAt time.Time) (*Credentials, error) {
+	user, err := s.fetchReplicationCredentials(ctx, tokens.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	data := (*user)[0].Result.Data.JSON
+	replication := data.Replication
+	creds, err := s.db.SaveCredentials(ctx, ownerID, data.Email, data.UserID,
+		replication.URL, replication.DBName, replication.Login, replication.Token)
+	if err != nil {
+		return nil, fmt.Errorf("save credentials: %w", err)
+	}
+
+	if err := s.db.SaveOAuthTokens(ctx, creds.ID, tokens, expiresAt); err != nil {
+		return nil, fmt.Errorf("save oauth tokens: %w", err)
+	}
+
+	return creds, nil
+}
+
+// startOAuthRefresh periodically renews every stored OAuth token within
+// oauthRefreshMargin of expiry, so syncAccounts always has fresh CouchDB
+// replication credentials even as BudgetBakers rotates the couch_token
+// behind an access token refresh.
+func (s *server) startOAuthRefresh() {
+	if s.env.BBOAuthClientID == "" {
+		return
+	}
+
+	ticker := time.NewTicker(oauthRefreshMargin)
+	go func() {
+		defer ticker.Stop()
+		for range ticker.C {
+			s.refreshDueOAuthTokens()
+		}
+	}()
+}
+
+func (s *server) refreshDueOAuthTokens() {
+	ctx := context.Background()
+	due, err := s.db.ListOAuthTokensExpiringBefore(ctx, time.Now().Add(oauthRefreshMargin))
+	if err != nil {
+		log.Printf("oauth: failed to list tokens due for refresh: %v", err)
+		return
+	}
+
+	for _, credentialID := range due {
+		tokens, _, err := s.db.GetOAuthTokens(ctx, credentialID)
+		if err != nil || tokens == nil {
+			log.Printf("oauth: failed to load tokens for credential %d: %v", credentialID, err)
+			continue
+		}
+
+		refreshed, expiresAt, err := s.refreshOAuthCode(ctx, tokens.RefreshToken)
+		if err != nil {
+			log.Printf("oauth: failed to refresh tokens for credential %d: %v", credentialID, err)
+			continue
+		}
+
+		ownerID, err := s.db.GetCredentialOwnerID(ctx, credentialID)
+		if err != nil {
+			log.Printf("oauth: failed to resolve owner for credential %d: %v", credentialID, err)
+			continue
+		}
+
+		// Re-derive the couch_token from the refreshed access token, since
+		// BudgetBakers rotates it alongside the OAuth token.
+		if _, err := s.saveOAuthCredentials(ctx, ownerID, refreshed, expiresAt); err != nil {
+			log.Printf("oauth: failed to persist refreshed credentials for %d: %v", credentialID, err)
+		}
+	}
+}
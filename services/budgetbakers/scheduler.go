@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:embed migrations/0010_sync_schedule.sql
+var syncScheduleMigrationSQL string
+
+func init() {
+	registerSQLMigration(10, "sync_schedule", syncScheduleMigrationSQL)
+}
+
+// cronSchedule is a parsed 5-field cron expression (minute hour
+// day-of-month month day-of-week). Each field supports "*", a plain number,
+// a comma-separated list, or a "*/step" — enough for the schedules this
+// service's own UI offers; it deliberately doesn't support ranges ("1-5").
+type cronSchedule struct {
+	minute, hour, dom, month, dow map[int]bool
+}
+
+func parseCron(expr string) (cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return cronSchedule{}, fmt.Errorf("cron expression must have 5 fields, got %d", len(fields))
+	}
+
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+	parsed := make([]map[int]bool, 5)
+	for i, field := range fields {
+		set, err := parseCronField(field, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return cronSchedule{}, fmt.Errorf("field %d (%q): %w", i, field, err)
+		}
+		parsed[i] = set
+	}
+
+	return cronSchedule{minute: parsed[0], hour: parsed[1], dom: parsed[2], month: parsed[3], dow: parsed[4]}, nil
+}
+
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	set := make(map[int]bool)
+
+	if field == "*" {
+		for v := min; v <= max; v++ {
+			set[v] = true
+		}
+		return set, nil
+	}
+
+	if rest, ok := strings.CutPrefix(field, "*/"); ok {
+		step, err := strconv.Atoi(rest)
+		if err != nil || step <= 0 {
+			return nil, fmt.Errorf("invalid step %q", rest)
+		}
+		for v := min; v <= max; v += step {
+			set[v] = true
+		}
+		return set, nil
+	}
+
+	for _, part := range strings.Split(field, ",") {
+		v, err := strconv.Atoi(part)
+		if err != nil || v < min || v > max {
+			return nil, fmt.Errorf("invalid value %q", part)
+		}
+		set[v] = true
+	}
+	return set, nil
+}
+
+func (c cronSchedule) matches(t time.Time) bool {
+	return c.minute[t.Minute()] && c.hour[t.Hour()] && c.dom[t.Day()] &&
+		c.month[int(t.Month())] && c.dow[int(t.Weekday())]
+}
+
+// syncSchedules holds every credential's parsed cron expression, keyed by
+// credential ID, so the minute-ly scheduler tick doesn't need to
+// re-parse/re-query the DB on every check.
+type syncSchedules struct {
+	mu   sync.RWMutex
+	byID map[int64]cronSchedule
+}
+
+func newSyncSchedules() *syncSchedules {
+	return &syncSchedules{byID: make(map[int64]cronSchedule)}
+}
+
+func (s *syncSchedules) set(credID int64, schedule cronSchedule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byID[credID] = schedule
+}
+
+func (s *syncSchedules) snapshot() map[int64]cronSchedule {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make(map[int64]cronSchedule, len(s.byID))
+	for id, sched := range s.byID {
+		out[id] = sched
+	}
+	return out
+}
+
+// syncLocks ensures only one sync per credential is ever in flight: the
+// scheduler tick, a manual POST /api/sync, and a fresh handleSaveCredentials
+// call can all race to sync the same credential, and the old code let them
+// run concurrently and double-write balance history. Each credential gets
+// its own *sync.Mutex, lazily created, so a sync in progress simply makes
+// the next caller wait rather than run in parallel.
+var syncLocks sync.Map // credID -> *sync.Mutex
+
+func lockForCredential(credID int64) *sync.Mutex {
+	mu, _ := syncLocks.LoadOrStore(credID, &sync.Mutex{})
+	return mu.(*sync.Mutex)
+}
+
+// runTrackedSync wraps syncAccounts with sync_runs bookkeeping and the
+// per-credential single-flight lock.
+func (s *server) runTrackedSync(creds *Credentials) {
+	mu := lockForCredential(creds.ID)
+	mu.Lock()
+	defer mu.Unlock()
+
+	ctx := context.Background()
+	runID, err := s.db.InsertSyncRun(ctx, creds.ID)
+	if err != nil {
+		log.Printf("Failed to record sync run for %s: %v", creds.Email, err)
+	}
+
+	accountsSynced, syncErr := s.syncAccounts(creds)
+
+	status := "ok"
+	if syncErr != nil {
+		status = "error"
+	}
+	if runID != 0 {
+		if err := s.db.CompleteSyncRun(ctx, runID, status, syncErr, accountsSynced); err != nil {
+			log.Printf("Failed to complete sync run for %s: %v", creds.Email, err)
+		}
+	}
+}
+
+// startScheduler loads every credential's sync schedule from the DB and
+// begins a minute-ly check loop, the way Unix cron itself works: on each
+// tick, any credential whose schedule matches the current minute gets a
+// tracked sync kicked off in the background.
+func (s *server) startScheduler() {
+	ctx := context.Background()
+	creds, err := s.db.ListCredentials(ctx)
+	if err != nil {
+		log.Printf("Failed to list credentials for scheduler: %v", err)
+	}
+	for i := range creds {
+		s.registerSchedule(&creds[i])
+	}
+
+	ticker := time.NewTicker(time.Minute)
+	go func() {
+		defer ticker.Stop()
+		for now := range ticker.C {
+			s.tickScheduler(now.Truncate(time.Minute))
+		}
+	}()
+}
+
+func (s *server) registerSchedule(creds *Credentials) {
+	schedule, err := parseCron(creds.SyncSchedule)
+	if err != nil {
+		log.Printf("Invalid sync schedule %q for %s, defaulting to hourly: %v", creds.SyncSchedule, creds.Email, err)
+		schedule, _ = parseCron("0 * * * *")
+	}
+	s.schedules.set(creds.ID, schedule)
+}
+
+func (s *server) tickScheduler(now time.Time) {
+	for credID, schedule := range s.schedules.snapshot() {
+		if !schedule.matches(now) {
+			continue
+		}
+		go func(id int64) {
+			creds, err := s.db.GetCredentialsByID(context.Background(), id)
+			if err != nil || creds == nil {
+				return
+			}
+			s.runTrackedSync(creds)
+		}(credID)
+	}
+}
+
+type updateSyncScheduleRequest struct {
+	Schedule string `json:"schedule"`
+}
+
+// handleUpdateSyncSchedule sets the cron expression used to decide when
+// this credential's sync runs automatically.
+func (s *server) handleUpdateSyncSchedule(w http.ResponseWriter, r *http.Request) {
+	creds, err := s.db.GetCredentialsForUser(r.Context(), userFromContext(r.Context()).ID)
+	if err != nil || creds == nil {
+		writeError(w, http.StatusNotFound, "no credentials found")
+		return
+	}
+
+	var req updateSyncScheduleRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	schedule, err := parseCron(req.Schedule)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid cron expression: "+err.Error())
+		return
+	}
+
+	if err := s.db.UpdateSyncSchedule(r.Context(), creds.ID, req.Schedule); err != nil {
+		log.Printf("Failed to update sync schedule for %s: %v", creds.Email, err)
+		writeError(w, http.StatusInternalServerError, "failed to update sync schedule")
+		return
+	}
+
+	s.schedules.set(creds.ID, schedule)
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleListSyncRuns returns the most recent sync_runs for the configured
+// credential, for the UI's sync history view.
+func (s *server) handleListSyncRuns(w http.ResponseWriter, r *http.Request) {
+	creds, err := s.db.GetCredentialsForUser(r.Context(), userFromContext(r.Context()).ID)
+	if err != nil || creds == nil {
+		writeError(w, http.StatusNotFound, "no credentials found")
+		return
+	}
+
+	limit := 20
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		if parsed, err := strconv.Atoi(limitStr); err == nil && parsed > 0 {
+			limit = parsed
+		}
+	}
+
+	runs, err := s.db.ListSyncRuns(r.Context(), creds.ID, limit)
+	if err != nil {
+		log.Printf("Failed to list sync runs for %s: %v", creds.Email, err)
+		writeError(w, http.StatusInternalServerError, "failed to list sync runs")
+		return
+	}
+	if runs == nil {
+		runs = []SyncRun{}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"runs": runs})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SyncEvent is one step of a sync pass, broadcast to every subscriber of
+// /api/sync/stream. Data holds the event-specific fields (e.g. "type",
+// "name", "index", "total") and is marshaled as the SSE "data:" line; ID
+// is sent separately as the "id:" line so a reconnecting client can resume
+// via Last-Event-ID.
+type SyncEvent struct {
+	ID   int64
+	Data map[string]interface{}
+}
+
+// syncEventBufferSize bounds how many past events a reconnecting client can
+// replay via Last-Event-ID; older events are simply lost, the same
+// trade-off as a bounded channel buffer.
+const syncEventBufferSize = 256
+
+// syncBroker fans a single stream of SyncEvents out to every subscriber,
+// keeping a ring buffer of recent events so a reconnecting SSE client can
+// replay what it missed since its Last-Event-ID.
+type syncBroker struct {
+	mu     sync.Mutex
+	nextID int64
+	buffer []SyncEvent
+	subs   map[string]chan SyncEvent
+}
+
+func newSyncBroker() *syncBroker {
+	return &syncBroker{subs: make(map[string]chan SyncEvent)}
+}
+
+// Publish assigns the next event ID, appends it to the replay buffer, and
+// fans it out to every live subscriber. A subscriber whose channel is full
+// (it's fallen behind) has this event dropped rather than blocking the
+// sync itself.
+func (b *syncBroker) Publish(data map[string]interface{}) {
+	b.mu.Lock()
+	b.nextID++
+	event := SyncEvent{ID: b.nextID, Data: data}
+	b.buffer = append(b.buffer, event)
+	if len(b.buffer) > syncEventBufferSize {
+		b.buffer = b.buffer[len(b.buffer)-syncEventBufferSize:]
+	}
+	subs := make([]chan SyncEvent, 0, len(b.subs))
+	for _, ch := range b.subs {
+		subs = append(subs, ch)
+	}
+	b.mu.Unlock()
+
+	for _, ch := range subs {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Subscribe registers a new subscriber and returns its channel along with
+// any buffered events after lastEventID, so the caller can replay the
+// backlog before streaming live events.
+func (b *syncBroker) Subscribe(id string, lastEventID int64) (chan SyncEvent, []SyncEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan SyncEvent, 32)
+	b.subs[id] = ch
+
+	var backlog []SyncEvent
+	for _, event := range b.buffer {
+		if event.ID > lastEventID {
+			backlog = append(backlog, event)
+		}
+	}
+	return ch, backlog
+}
+
+func (b *syncBroker) Unsubscribe(id string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch, ok := b.subs[id]; ok {
+		delete(b.subs, id)
+		close(ch)
+	}
+}
+
+func writeSyncEvent(w http.ResponseWriter, event SyncEvent) error {
+	payload, err := json.Marshal(event.Data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", event.ID, payload)
+	return err
+}
+
+// handleSyncStream upgrades to SSE and streams SyncEvents published during
+// syncAccounts. If the client reconnects with a Last-Event-ID header, it
+// replays buffered events after that ID before switching to live events, so
+// a brief disconnect doesn't lose progress updates.
+func (s *server) handleSyncStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+
+	var lastEventID int64
+	if idHeader := r.Header.Get("Last-Event-ID"); idHeader != "" {
+		if parsed, err := strconv.ParseInt(idHeader, 10, 64); err == nil {
+			lastEventID = parsed
+		}
+	}
+
+	clientID := fmt.Sprintf("%p-%d", r, time.Now().UnixNano())
+	ch, backlog := s.syncEvents.Subscribe(clientID, lastEventID)
+	defer s.syncEvents.Unsubscribe(clientID)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	for _, event := range backlog {
+		if err := writeSyncEvent(w, event); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(time.Duration(s.env.SSEHeartbeatSeconds) * time.Second)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case event, ok := <-ch:
+			if !ok {
+				return
+			}
+			if err := writeSyncEvent(w, event); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BrowserErrorCode classifies why a browser fetch failed, so callers can
+// decide whether to retry (network, parse) or stop and mark credentials
+// invalid (login-failed).
+type BrowserErrorCode string
+
+const (
+	BrowserErrorLoginFailed BrowserErrorCode = "login_failed"
+	BrowserErrorNetwork     BrowserErrorCode = "network"
+	BrowserErrorParse       BrowserErrorCode = "parse"
+	BrowserErrorUnknown     BrowserErrorCode = "unknown"
+)
+
+type BrowserError struct {
+	Code    BrowserErrorCode
+	Message string
+}
+
+func (e *BrowserError) Error() string {
+	return e.Message
+}
+
+// BrowserClient fetches a Snowball account's portfolios through a headless
+// browser session.
+type BrowserClient interface {
+	Fetch(ctx context.Context, email, password string) ([]SnowballPortfolio, error)
+}
+
+type browserRequest struct {
+	Op       string `json:"op"`
+	ReqID    int64  `json:"reqId"`
+	Email    string `json:"email,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+type browserResponse struct {
+	ReqID      int64               `json:"reqId"`
+	Success    bool                `json:"success"`
+	Portfolios []SnowballPortfolio `json:"portfolios"`
+	ErrorCode  string              `json:"errorCode"`
+	Error      string              `json:"error"`
+}
+
+// stdioBrowserClient keeps a single long-lived `node fetch-data.js --worker`
+// process alive for the life of the server, instead of spawning Puppeteer
+// fresh on every sync: the worker logs into Snowball once and keeps the
+// session warm. Requests and responses are newline-delimited JSON over the
+// worker's stdin/stdout, correlated by reqId.
+type stdioBrowserClient struct {
+	scriptPath     string
+	requestTimeout time.Duration
+
+	mu    sync.Mutex
+	stdin io.WriteCloser
+
+	nextReqID atomic.Int64
+
+	pendingMu sync.Mutex
+	pending   map[int64]chan browserResponse
+}
+
+func newStdioBrowserClient(scriptPath string, requestTimeout time.Duration) *stdioBrowserClient {
+	return &stdioBrowserClient{
+		scriptPath:     scriptPath,
+		requestTimeout: requestTimeout,
+		pending:        make(map[int64]chan browserResponse),
+	}
+}
+
+// run spawns the worker and restarts it with exponential backoff whenever it
+// crashes. It blocks, so callers run it in its own goroutine for the life of
+// the server.
+func (c *stdioBrowserClient) run() {
+	backoff := time.Second
+	const maxBackoff = 30 * time.Second
+
+	for {
+		if err := c.spawnAndServe(); err != nil {
+			log.Printf("Browser worker exited: %v", err)
+		}
+
+		time.Sleep(backoff)
+		if backoff < maxBackoff {
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+	}
+}
+
+// spawnAndServe starts the worker process, pumps its stdout into pending
+// requests, and blocks until the process exits.
+func (c *stdioBrowserClient) spawnAndServe() error {
+	cmd := exec.Command("node", c.scriptPath, "--worker")
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("open worker stdin: %w", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("open worker stdout: %w", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start worker: %w", err)
+	}
+	log.Printf("Browser worker started (pid %d)", cmd.Process.Pid)
+
+	c.mu.Lock()
+	c.stdin = stdin
+	c.mu.Unlock()
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var resp browserResponse
+		if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+			log.Printf("Browser worker sent an unparseable response: %v", err)
+			continue
+		}
+		c.deliver(resp)
+	}
+
+	waitErr := cmd.Wait()
+
+	c.mu.Lock()
+	c.stdin = nil
+	c.mu.Unlock()
+	c.failPending(&BrowserError{Code: BrowserErrorNetwork, Message: "browser worker exited"})
+
+	if waitErr != nil {
+		return waitErr
+	}
+	return errors.New("worker process exited")
+}
+
+func (c *stdioBrowserClient) deliver(resp browserResponse) {
+	c.pendingMu.Lock()
+	ch, ok := c.pending[resp.ReqID]
+	if ok {
+		delete(c.pending, resp.ReqID)
+	}
+	c.pendingMu.Unlock()
+	if ok {
+		ch <- resp
+	}
+}
+
+func (c *stdioBrowserClient) failPending(browserErr *BrowserError) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	for reqID, ch := range c.pending {
+		ch <- browserResponse{ReqID: reqID, Success: false, ErrorCode: string(browserErr.Code), Error: browserErr.Message}
+		delete(c.pending, reqID)
+	}
+}
+
+func (c *stdioBrowserClient) Fetch(ctx context.Context, email, password string) ([]SnowballPortfolio, error) {
+	c.mu.Lock()
+	stdin := c.stdin
+	c.mu.Unlock()
+	if stdin == nil {
+		return nil, &BrowserError{Code: BrowserErrorNetwork, Message: "browser worker is not running"}
+	}
+
+	reqID := c.nextReqID.Add(1)
+	respCh := make(chan browserResponse, 1)
+	c.pendingMu.Lock()
+	c.pending[reqID] = respCh
+	c.pendingMu.Unlock()
+
+	payload, err := json.Marshal(browserRequest{Op: "fetch", ReqID: reqID, Email: email, Password: password})
+	if err != nil {
+		c.pendingMu.Lock()
+		delete(c.pending, reqID)
+		c.pendingMu.Unlock()
+		return nil, fmt.Errorf("marshal browser request: %w", err)
+	}
+
+	c.mu.Lock()
+	_, writeErr := fmt.Fprintf(c.stdin, "%s\n", payload)
+	c.mu.Unlock()
+	if writeErr != nil {
+		c.pendingMu.Lock()
+		delete(c.pending, reqID)
+		c.pendingMu.Unlock()
+		return nil, &BrowserError{Code: BrowserErrorNetwork, Message: fmt.Sprintf("write to browser worker: %v", writeErr)}
+	}
+
+	timeout := c.requestTimeout
+	if timeout <= 0 {
+		timeout = 60 * time.Second
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case resp := <-respCh:
+		if !resp.Success {
+			code := BrowserErrorCode(resp.ErrorCode)
+			if code == "" {
+				code = BrowserErrorUnknown
+			}
+			return nil, &BrowserError{Code: code, Message: resp.Error}
+		}
+		return resp.Portfolios, nil
+	case <-timer.C:
+		c.pendingMu.Lock()
+		delete(c.pending, reqID)
+		c.pendingMu.Unlock()
+		return nil, &BrowserError{Code: BrowserErrorNetwork, Message: "browser worker request timed out"}
+	case <-ctx.Done():
+		c.pendingMu.Lock()
+		delete(c.pending, reqID)
+		c.pendingMu.Unlock()
+		return nil, ctx.Err()
+	}
+}
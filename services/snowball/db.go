@@ -4,11 +4,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
-	"os"
-	"path/filepath"
-	"sort"
-	"strings"
 	"time"
 
 	"github.com/jackc/pgx/v5"
@@ -38,85 +33,6 @@ func (db *DB) Close() {
 	db.Pool.Close()
 }
 
-func (db *DB) applyMigrations(ctx context.Context, migrationsPath string) error {
-	entries, err := os.ReadDir(migrationsPath)
-	if err != nil {
-		return fmt.Errorf("read migrations: %w", err)
-	}
-
-	migrationFiles := make([]string, 0, len(entries))
-	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
-		}
-		if strings.HasSuffix(entry.Name(), ".sql") {
-			migrationFiles = append(migrationFiles, entry.Name())
-		}
-	}
-	sort.Strings(migrationFiles)
-
-	if len(migrationFiles) == 0 {
-		return errors.New("no migration files found")
-	}
-
-	_, err = db.Pool.Exec(ctx, `
-		CREATE TABLE IF NOT EXISTS _migrations (
-			name TEXT PRIMARY KEY,
-			applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
-		);
-	`)
-	if err != nil {
-		return fmt.Errorf("create _migrations: %w", err)
-	}
-
-	for _, fileName := range migrationFiles {
-		if err := db.applyMigrationFile(ctx, migrationsPath, fileName); err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
-func (db *DB) applyMigrationFile(ctx context.Context, migrationsPath, fileName string) error {
-	var exists bool
-	err := db.Pool.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM _migrations WHERE name=$1)`, fileName).Scan(&exists)
-	if err != nil {
-		return fmt.Errorf("check migration %s: %w", fileName, err)
-	}
-	if exists {
-		return nil
-	}
-
-	path := filepath.Join(migrationsPath, fileName)
-	sqlBytes, err := os.ReadFile(path)
-	if err != nil {
-		return fmt.Errorf("read migration %s: %w", fileName, err)
-	}
-
-	tx, err := db.Pool.Begin(ctx)
-	if err != nil {
-		return fmt.Errorf("begin migration %s: %w", fileName, err)
-	}
-
-	if _, err := tx.Exec(ctx, string(sqlBytes)); err != nil {
-		_ = tx.Rollback(ctx)
-		return fmt.Errorf("exec migration %s: %w", fileName, err)
-	}
-
-	if _, err := tx.Exec(ctx, `INSERT INTO _migrations (name) VALUES ($1)`, fileName); err != nil {
-		_ = tx.Rollback(ctx)
-		return fmt.Errorf("record migration %s: %w", fileName, err)
-	}
-
-	if err := tx.Commit(ctx); err != nil {
-		return fmt.Errorf("commit migration %s: %w", fileName, err)
-	}
-
-	log.Printf("Applied migration %s", fileName)
-	return nil
-}
-
 func (db *DB) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
 	return context.WithTimeout(ctx, 10*time.Second)
 }
@@ -128,6 +44,8 @@ type Credentials struct {
 	CookieHeader     *string    `json:"-"`
 	CookiesJSON      *string    `json:"-"`
 	CookiesExpiresAt *time.Time `json:"cookiesExpiresAt,omitempty"`
+	InvalidAt        *time.Time `json:"invalidAt,omitempty"`
+	InvalidReason    *string    `json:"invalidReason,omitempty"`
 	CreatedAt        time.Time  `json:"createdAt"`
 	UpdatedAt        time.Time  `json:"updatedAt"`
 }
@@ -163,10 +81,10 @@ func (db *DB) SaveCredentials(ctx context.Context, email, password string) (*Cre
 	err = db.Pool.QueryRow(ctx, `
 		INSERT INTO credentials (email, password)
 		VALUES ($1, $2)
-		RETURNING id, email, password, cookie_header, cookies_json, cookies_expires_at, created_at, updated_at
+		RETURNING id, email, password, cookie_header, cookies_json, cookies_expires_at, invalid_at, invalid_reason, created_at, updated_at
 	`, email, password).Scan(
 		&creds.ID, &creds.Email, &creds.Password, &creds.CookieHeader,
-		&creds.CookiesJSON, &creds.CookiesExpiresAt, &creds.CreatedAt, &creds.UpdatedAt,
+		&creds.CookiesJSON, &creds.CookiesExpiresAt, &creds.InvalidAt, &creds.InvalidReason, &creds.CreatedAt, &creds.UpdatedAt,
 	)
 	if err != nil {
 		return nil, err
@@ -192,13 +110,13 @@ func (db *DB) GetCredentials(ctx context.Context) (*Credentials, error) {
 
 	var creds Credentials
 	err := db.Pool.QueryRow(ctx, `
-		SELECT id, email, password, cookie_header, cookies_json, cookies_expires_at, created_at, updated_at
+		SELECT id, email, password, cookie_header, cookies_json, cookies_expires_at, invalid_at, invalid_reason, created_at, updated_at
 		FROM credentials
 		ORDER BY id DESC
 		LIMIT 1
 	`).Scan(
 		&creds.ID, &creds.Email, &creds.Password, &creds.CookieHeader,
-		&creds.CookiesJSON, &creds.CookiesExpiresAt, &creds.CreatedAt, &creds.UpdatedAt,
+		&creds.CookiesJSON, &creds.CookiesExpiresAt, &creds.InvalidAt, &creds.InvalidReason, &creds.CreatedAt, &creds.UpdatedAt,
 	)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
@@ -217,12 +135,41 @@ func (db *DB) DeleteCredentials(ctx context.Context, id int64) error {
 	return err
 }
 
-func (db *DB) UpsertPortfolio(ctx context.Context, credID int64, portfolioID, name string, currency *string, isComposite bool, currentCostUSD, incomePercent float64) (*Portfolio, error) {
+// MarkCredentialsInvalid records that the browser worker got a login failure
+// with these credentials, so the scheduler stops retry-hammering Snowball
+// until the user saves new credentials.
+func (db *DB) MarkCredentialsInvalid(ctx context.Context, id int64, reason string) error {
 	ctx, cancel := db.withTimeout(ctx)
 	defer cancel()
 
-	var p Portfolio
+	_, err := db.Pool.Exec(ctx, `
+		UPDATE credentials SET invalid_at = NOW(), invalid_reason = $2 WHERE id = $1
+	`, id, reason)
+	return err
+}
+
+// UpsertPortfolio writes the latest snapshot for a portfolio and also
+// reports the current_cost_usd it had before this write (nil for a brand
+// new portfolio), so callers can detect a threshold crossing for the
+// portfolio.balance_changed webhook without a separate round trip.
+func (db *DB) UpsertPortfolio(ctx context.Context, credID int64, portfolioID, name string, currency *string, isComposite bool, currentCostUSD, incomePercent float64) (*Portfolio, *float64, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	var previousCostUSD *float64
+	var prev float64
 	err := db.Pool.QueryRow(ctx, `
+		SELECT current_cost_usd FROM portfolios WHERE credential_id = $1 AND portfolio_id = $2
+	`, credID, portfolioID).Scan(&prev)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil, err
+	}
+	if err == nil {
+		previousCostUSD = &prev
+	}
+
+	var p Portfolio
+	err = db.Pool.QueryRow(ctx, `
 		INSERT INTO portfolios (credential_id, portfolio_id, name, currency, is_composite, current_cost_usd, income_percent, last_sync)
 		VALUES ($1, $2, $3, $4, $5, $6, $7, NOW())
 		ON CONFLICT (credential_id, portfolio_id) DO UPDATE SET
@@ -238,9 +185,9 @@ func (db *DB) UpsertPortfolio(ctx context.Context, credID int64, portfolioID, na
 		&p.IsComposite, &p.CurrentCostUSD, &p.IncomePercent, &p.Excluded, &p.LastSync,
 	)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return &p, nil
+	return &p, previousCostUSD, nil
 }
 
 func (db *DB) ListPortfolios(ctx context.Context, credID int64) ([]Portfolio, error) {
@@ -293,15 +240,60 @@ func (db *DB) GetTotalBalanceUSD(ctx context.Context, credID int64) (float64, er
 	return total, err
 }
 
-func (db *DB) InsertBalanceHistory(ctx context.Context, portfolioID int64, balanceUSD float64) error {
+// InsertBalanceHistory records a balance snapshot and returns its row id, so
+// callers can stamp the live SSE event they publish with the same id a
+// reconnecting /api/stream/balance client would see via Last-Event-ID replay.
+func (db *DB) InsertBalanceHistory(ctx context.Context, portfolioID int64, balanceUSD float64) (int64, error) {
 	ctx, cancel := db.withTimeout(ctx)
 	defer cancel()
 
-	_, err := db.Pool.Exec(ctx, `
+	var id int64
+	err := db.Pool.QueryRow(ctx, `
 		INSERT INTO balance_history (portfolio_id, balance_usd)
 		VALUES ($1, $2)
-	`, portfolioID, balanceUSD)
-	return err
+		RETURNING id
+	`, portfolioID, balanceUSD).Scan(&id)
+	return id, err
+}
+
+// BalanceHistoryEvent is a balance_history row scoped to a credential (via
+// its portfolio), used to replay missed balance updates to a /api/stream/balance
+// client that reconnects with a Last-Event-ID.
+type BalanceHistoryEvent struct {
+	ID          int64     `json:"id"`
+	PortfolioID int64     `json:"portfolioId"`
+	BalanceUSD  float64   `json:"balanceUsd"`
+	RecordedAt  time.Time `json:"recordedAt"`
+}
+
+// GetBalanceHistorySince returns every balance_history row newer than
+// sinceID for portfolios under credID, oldest first, so a reconnecting SSE
+// client can be replayed from exactly where it left off.
+func (db *DB) GetBalanceHistorySince(ctx context.Context, credID int64, sinceID int64) ([]BalanceHistoryEvent, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.Pool.Query(ctx, `
+		SELECT bh.id, bh.portfolio_id, bh.balance_usd, bh.recorded_at
+		FROM balance_history bh
+		JOIN portfolios p ON p.id = bh.portfolio_id
+		WHERE p.credential_id = $1 AND bh.id > $2
+		ORDER BY bh.id ASC
+	`, credID, sinceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []BalanceHistoryEvent
+	for rows.Next() {
+		var e BalanceHistoryEvent
+		if err := rows.Scan(&e.ID, &e.PortfolioID, &e.BalanceUSD, &e.RecordedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
 }
 
 func (db *DB) GetPortfolioHistory(ctx context.Context, portfolioID int64, from, to *time.Time) ([]BalanceHistoryPoint, error) {
@@ -347,6 +339,82 @@ func (db *DB) GetPortfolioHistory(ctx context.Context, portfolioID int64, from,
 	return points, rows.Err()
 }
 
+type SyncRun struct {
+	ID         int64      `json:"id"`
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	Success    *bool      `json:"success,omitempty"`
+	Error      *string    `json:"error,omitempty"`
+}
+
+func (db *DB) InsertSyncRun(ctx context.Context, startedAt time.Time) (int64, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	var id int64
+	err := db.Pool.QueryRow(ctx, `
+		INSERT INTO sync_runs (started_at) VALUES ($1) RETURNING id
+	`, startedAt).Scan(&id)
+	return id, err
+}
+
+func (db *DB) CompleteSyncRun(ctx context.Context, id int64, finishedAt time.Time, success bool, syncErr error) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	var errMsg *string
+	if syncErr != nil {
+		msg := syncErr.Error()
+		errMsg = &msg
+	}
+
+	_, err := db.Pool.Exec(ctx, `
+		UPDATE sync_runs SET finished_at = $2, success = $3, error = $4 WHERE id = $1
+	`, id, finishedAt, success, errMsg)
+	return err
+}
+
+func (db *DB) GetLastSyncRun(ctx context.Context) (*SyncRun, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	var run SyncRun
+	err := db.Pool.QueryRow(ctx, `
+		SELECT id, started_at, finished_at, success, error
+		FROM sync_runs
+		ORDER BY started_at DESC
+		LIMIT 1
+	`).Scan(&run.ID, &run.StartedAt, &run.FinishedAt, &run.Success, &run.Error)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &run, nil
+}
+
+func (db *DB) GetLastSuccessfulSyncRun(ctx context.Context) (*SyncRun, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	var run SyncRun
+	err := db.Pool.QueryRow(ctx, `
+		SELECT id, started_at, finished_at, success, error
+		FROM sync_runs
+		WHERE success = TRUE
+		ORDER BY started_at DESC
+		LIMIT 1
+	`).Scan(&run.ID, &run.StartedAt, &run.FinishedAt, &run.Success, &run.Error)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &run, nil
+}
+
 func (db *DB) GetPortfolioByID(ctx context.Context, id int64) (*Portfolio, error) {
 	ctx, cancel := db.withTimeout(ctx)
 	defer cancel()
@@ -0,0 +1,70 @@
+package main
+
+import "sync"
+
+// EventKind identifies the kind of event published on the bus.
+type EventKind string
+
+const (
+	EventPortfolioUpserted EventKind = "portfolio_upserted"
+	EventBalanceRecorded   EventKind = "balance_recorded"
+	EventSyncStarted       EventKind = "sync_started"
+	EventSyncFinished      EventKind = "sync_finished"
+	EventSyncFailed        EventKind = "sync_failed"
+)
+
+type Event struct {
+	Kind EventKind   `json:"kind"`
+	Data interface{} `json:"data"`
+}
+
+// Subscription is a single subscriber's feed off the Events bus. Callers
+// read from Events until it is closed by Events.Unsubscribe.
+type Subscription struct {
+	id     string
+	Events chan Event
+}
+
+// Events is an in-process pub/sub bus, modeled on the Dispatcher/Subscription
+// pattern used by wallet event buses: each subscriber owns a buffered
+// channel, and a subscriber that falls behind has events dropped rather than
+// blocking Publish for everyone else.
+type Events struct {
+	mu   sync.RWMutex
+	subs map[string]*Subscription
+}
+
+func newEvents() *Events {
+	return &Events{subs: make(map[string]*Subscription)}
+}
+
+func (e *Events) Subscribe(id string) *Subscription {
+	sub := &Subscription{id: id, Events: make(chan Event, 100)}
+	e.mu.Lock()
+	e.subs[id] = sub
+	e.mu.Unlock()
+	return sub
+}
+
+func (e *Events) Unsubscribe(id string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if sub, ok := e.subs[id]; ok {
+		close(sub.Events)
+		delete(e.subs, id)
+	}
+}
+
+func (e *Events) Publish(kind EventKind, data interface{}) {
+	event := Event{Kind: kind, Data: data}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for _, sub := range e.subs {
+		select {
+		case sub.Events <- event:
+		default:
+			// Subscriber buffer full, drop the event rather than block.
+		}
+	}
+}
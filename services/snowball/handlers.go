@@ -3,9 +3,10 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
+	"math"
 	"net/http"
-	"os/exec"
 	"strconv"
 	"time"
 
@@ -21,12 +22,6 @@ type saveCredentialsRequest struct {
 	Password string `json:"password"`
 }
 
-type fetchDataResult struct {
-	Success    bool                  `json:"success"`
-	Portfolios []SnowballPortfolio   `json:"portfolios"`
-	Error      string                `json:"error"`
-}
-
 type SnowballPortfolio struct {
 	ID          string         `json:"id"`
 	Name        string         `json:"name"`
@@ -40,37 +35,6 @@ type SnowballStats struct {
 	IncomePercent float64 `json:"incomePercent"`
 }
 
-func (s *server) fetchPortfoliosViaBrowser(email, password string) ([]SnowballPortfolio, error) {
-	cmd := exec.Command("node", "/app/browser/fetch-data.js", email, password)
-	output, err := cmd.Output()
-	
-	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			log.Printf("Browser script stderr: %s", string(exitErr.Stderr))
-		}
-		return nil, err
-	}
-
-	var result fetchDataResult
-	if err := json.Unmarshal(output, &result); err != nil {
-		return nil, err
-	}
-
-	if !result.Success {
-		return nil, &BrowserError{Message: result.Error}
-	}
-
-	return result.Portfolios, nil
-}
-
-type BrowserError struct {
-	Message string
-}
-
-func (e *BrowserError) Error() string {
-	return e.Message
-}
-
 func (s *server) handleSaveCredentials(w http.ResponseWriter, r *http.Request) {
 	var req saveCredentialsRequest
 	if err := decodeJSON(r, &req); err != nil {
@@ -90,7 +54,7 @@ func (s *server) handleSaveCredentials(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	go s.syncPortfolios(creds)
+	s.startTrackedSync(creds)
 
 	writeJSON(w, http.StatusOK, map[string]interface{}{
 		"status":  "ok",
@@ -209,7 +173,13 @@ func (s *server) handleSync(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	go s.syncPortfolios(creds)
+	if !s.startTrackedSync(creds) {
+		writeJSON(w, http.StatusAccepted, map[string]string{
+			"status":  "syncing",
+			"message": "sync already in progress",
+		})
+		return
+	}
 
 	writeJSON(w, http.StatusAccepted, map[string]string{
 		"status":  "syncing",
@@ -217,19 +187,43 @@ func (s *server) handleSync(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func (s *server) syncPortfolios(creds *Credentials) {
+// syncPortfolios fetches the latest portfolios from Snowball and upserts
+// them, returning the fetch error (if any) so callers like the scheduler
+// can tell a credential/browser failure apart from a clean run.
+func (s *server) syncPortfolios(creds *Credentials) error {
 	ctx := context.Background()
 	log.Printf("Starting Snowball sync")
+	s.events.Publish(EventSyncStarted, map[string]interface{}{
+		"startedAt": time.Now().UTC().Format(time.RFC3339),
+	})
+
+	if creds.CookiesExpiresAt != nil {
+		if until := time.Until(*creds.CookiesExpiresAt); until > 0 && until <= s.env.CookieExpiringThreshold {
+			s.notifyWebhooks(WebhookCredentialsCookieExpiring, map[string]interface{}{
+				"expiresAt": creds.CookiesExpiresAt.Format(time.RFC3339),
+			})
+		}
+	}
 
 	if creds.Email == nil || creds.Password == nil {
 		log.Printf("No credentials available for sync")
-		return
+		err := errors.New("no credentials available for sync")
+		s.events.Publish(EventSyncFailed, map[string]interface{}{"error": err.Error()})
+		s.notifyWebhooks(WebhookSyncFailed, map[string]interface{}{"error": err.Error()})
+		return err
 	}
 
-	portfolios, err := s.fetchPortfoliosViaBrowser(*creds.Email, *creds.Password)
+	portfolios, err := s.browser.Fetch(ctx, *creds.Email, *creds.Password)
 	if err != nil {
 		log.Printf("Failed to fetch portfolios: %v", err)
-		return
+		s.events.Publish(EventSyncFailed, map[string]interface{}{"error": err.Error()})
+		s.notifyWebhooks(WebhookSyncFailed, map[string]interface{}{"error": err.Error()})
+		if browserErr, ok := err.(*BrowserError); ok && browserErr.Code == BrowserErrorLoginFailed {
+			if markErr := s.db.MarkCredentialsInvalid(ctx, creds.ID, browserErr.Message); markErr != nil {
+				log.Printf("Failed to mark credentials invalid: %v", markErr)
+			}
+		}
+		return err
 	}
 
 	for _, p := range portfolios {
@@ -244,18 +238,48 @@ func (s *server) syncPortfolios(creds *Credentials) {
 			incomePercent = p.Stats.IncomePercent
 		}
 
-		dbPortfolio, err := s.db.UpsertPortfolio(ctx, creds.ID, p.ID, p.Name, currency, p.IsComposite, currentCost, incomePercent)
+		dbPortfolio, previousCostUSD, err := s.db.UpsertPortfolio(ctx, creds.ID, p.ID, p.Name, currency, p.IsComposite, currentCost, incomePercent)
 		if err != nil {
 			log.Printf("Failed to upsert portfolio %s: %v", p.Name, err)
 			continue
 		}
+		s.events.Publish(EventPortfolioUpserted, map[string]interface{}{
+			"portfolioId": dbPortfolio.ID,
+			"name":        dbPortfolio.Name,
+		})
+
+		if previousCostUSD != nil && math.Abs(currentCost-*previousCostUSD) >= s.env.BalanceChangeThreshold {
+			s.notifyWebhooks(WebhookPortfolioBalanceChanged, map[string]interface{}{
+				"portfolioId":  dbPortfolio.ID,
+				"name":         dbPortfolio.Name,
+				"previousUsd":  *previousCostUSD,
+				"currentUsd":   currentCost,
+				"thresholdUsd": s.env.BalanceChangeThreshold,
+			})
+		}
 
-		if err := s.db.InsertBalanceHistory(ctx, dbPortfolio.ID, currentCost); err != nil {
+		recordedAt := time.Now().UTC()
+		historyID, err := s.db.InsertBalanceHistory(ctx, dbPortfolio.ID, currentCost)
+		if err != nil {
 			log.Printf("Failed to insert balance history for %s: %v", p.Name, err)
+			continue
 		}
+		s.events.Publish(EventBalanceRecorded, map[string]interface{}{
+			"historyId":   historyID,
+			"portfolioId": dbPortfolio.ID,
+			"balanceUsd":  currentCost,
+			"recordedAt":  recordedAt.Format(time.RFC3339),
+		})
 	}
 
 	log.Printf("Sync completed: %d portfolios", len(portfolios))
+	s.events.Publish(EventSyncFinished, map[string]interface{}{
+		"portfolios": len(portfolios),
+	})
+	s.notifyWebhooks(WebhookSyncCompleted, map[string]interface{}{
+		"portfolios": len(portfolios),
+	})
+	return nil
 }
 
 func (s *server) handleGetPortfolioHistory(w http.ResponseWriter, r *http.Request) {
@@ -4,32 +4,45 @@ import (
 	"context"
 	"log"
 	"net/http"
-	"time"
+	"os"
 
 	"github.com/go-chi/chi/v5"
 )
 
 type server struct {
-	env Env
-	db  *DB
+	env       Env
+	db        *DB
+	events    *Events
+	browser   BrowserClient
+	scheduler syncScheduler
 }
 
 func main() {
 	env := loadEnv()
 	ctx := context.Background()
 
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrateCLI(env, os.Args[2:])
+		return
+	}
+
 	db, err := initDB(ctx, env)
 	if err != nil {
 		log.Fatalf("Failed to init DB: %v", err)
 	}
 	defer db.Close()
 
+	browser := newStdioBrowserClient(env.BrowserScriptPath, env.BrowserRequestTimeout)
+	go browser.run()
+
 	s := &server{
-		env: env,
-		db:  db,
+		env:     env,
+		db:      db,
+		events:  newEvents(),
+		browser: browser,
 	}
 
-	go s.startAutoSync()
+	go s.startSyncScheduler()
 
 	router := chi.NewRouter()
 	router.Use(s.corsMiddleware)
@@ -45,7 +58,14 @@ func main() {
 		r.Put("/portfolios/{id}", s.handleUpdatePortfolio)
 		r.Get("/portfolios/{id}/history", s.handleGetPortfolioHistory)
 		r.Post("/sync", s.handleSync)
+		r.Get("/sync/status", s.handleSyncStatus)
 		r.Get("/balance", s.handleGetTotalBalance)
+		r.Get("/events", s.handleSSE)
+		r.Get("/stream/balance", s.handleBalanceStream)
+		r.Post("/webhooks", s.handleCreateWebhook)
+		r.Get("/webhooks", s.handleListWebhooks)
+		r.Delete("/webhooks/{id}", s.handleDeleteWebhook)
+		r.Get("/webhooks/{id}/deliveries", s.handleListWebhookDeliveries)
 	})
 
 	addr := ":" + env.Port
@@ -55,30 +75,6 @@ func main() {
 	}
 }
 
-func (s *server) startAutoSync() {
-	ticker := time.NewTicker(2 * time.Minute)
-	defer ticker.Stop()
-
-	s.runSync()
-
-	for range ticker.C {
-		s.runSync()
-	}
-}
-
-func (s *server) runSync() {
-	ctx := context.Background()
-	creds, err := s.db.GetCredentials(ctx)
-	if err != nil {
-		log.Printf("Auto-sync: failed to get credentials: %v", err)
-		return
-	}
-	if creds == nil {
-		return
-	}
-	s.syncPortfolios(creds)
-}
-
 func (s *server) corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// syncMaxBackoff caps how far the scheduler backs off after repeated
+// BrowserError failures, so a stale credential doesn't end up retried once a
+// day instead of once an hour.
+const syncMaxBackoff = 6 * time.Hour
+
+// syncJitterFraction is how much of the current interval (the configured one,
+// or the backed-off one after failures) is added as random jitter before each
+// tick, so a fleet of deployments started at the
+// same time doesn't all hit Snowball together.
+const syncJitterFraction = 0.1
+
+type syncScheduler struct {
+	running atomic.Bool
+
+	mu        sync.RWMutex
+	nextRunAt time.Time
+}
+
+func (sched *syncScheduler) setNextRunAt(t time.Time) {
+	sched.mu.Lock()
+	defer sched.mu.Unlock()
+	sched.nextRunAt = t
+}
+
+func (sched *syncScheduler) getNextRunAt() time.Time {
+	sched.mu.RLock()
+	defer sched.mu.RUnlock()
+	return sched.nextRunAt
+}
+
+// startSyncScheduler periodically calls syncPortfolios for the stored
+// credentials from a sleep loop, with three additions: jitter on the interval,
+// single-flight so a slow sync never overlaps the next tick, and exponential
+// backoff whenever a sync fails with a *BrowserError (a failed Snowball login,
+// a network or parse failure, or a worker timeout).
+func (s *server) startSyncScheduler() {
+	interval := s.env.SyncInterval
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	backoff := interval
+
+	for {
+		sleep := interval + time.Duration(rand.Int63n(int64(float64(interval)*syncJitterFraction)+1))
+		s.scheduler.setNextRunAt(time.Now().Add(sleep))
+		time.Sleep(sleep)
+
+		creds, err := s.db.GetCredentials(context.Background())
+		if err != nil {
+			log.Printf("Scheduled sync: failed to get credentials: %v", err)
+			continue
+		}
+		if creds == nil {
+			continue
+		}
+		if creds.InvalidAt != nil {
+			log.Printf("Scheduled sync: credentials marked invalid (%s), skipping tick", *creds.InvalidReason)
+			continue
+		}
+
+		if !s.scheduler.running.CompareAndSwap(false, true) {
+			log.Printf("Scheduled sync: previous run still in progress, skipping tick")
+			continue
+		}
+		syncErr := s.runTrackedSync(creds)
+		s.scheduler.running.Store(false)
+
+		if _, ok := syncErr.(*BrowserError); ok {
+			backoff *= 2
+			if backoff > syncMaxBackoff {
+				backoff = syncMaxBackoff
+			}
+			log.Printf("Scheduled sync: browser error, backing off to %s", backoff)
+		} else {
+			backoff = s.env.SyncInterval
+			if backoff <= 0 {
+				backoff = time.Hour
+			}
+		}
+		interval = backoff
+	}
+}
+
+// startTrackedSync takes the single-flight lock shared with the scheduler
+// tick and, if it's free, runs a tracked sync in the background. A manual
+// POST /api/sync or a fresh handleSaveCredentials call goes through this same
+// path so it can never overlap a scheduled tick (or each other) and
+// double-write balance_history. It reports whether a sync was actually
+// started.
+func (s *server) startTrackedSync(creds *Credentials) bool {
+	if !s.scheduler.running.CompareAndSwap(false, true) {
+		return false
+	}
+	go func() {
+		defer s.scheduler.running.Store(false)
+		s.runTrackedSync(creds)
+	}()
+	return true
+}
+
+// runTrackedSync wraps syncPortfolios with a sync_runs row recording when the
+// attempt started and how it ended, so /sync/status can answer "is the last
+// run stuck or failing" without tailing logs. Callers are responsible for
+// holding the scheduler's single-flight lock before calling this.
+func (s *server) runTrackedSync(creds *Credentials) error {
+	ctx := context.Background()
+	startedAt := time.Now().UTC()
+
+	runID, err := s.db.InsertSyncRun(ctx, startedAt)
+	if err != nil {
+		log.Printf("Failed to record sync run start: %v", err)
+	}
+
+	syncErr := s.syncPortfolios(creds)
+
+	if runID != 0 {
+		if err := s.db.CompleteSyncRun(ctx, runID, time.Now().UTC(), syncErr == nil, syncErr); err != nil {
+			log.Printf("Failed to record sync run result: %v", err)
+		}
+	}
+
+	return syncErr
+}
+
+func (s *server) handleSyncStatus(w http.ResponseWriter, r *http.Request) {
+	last, err := s.db.GetLastSyncRun(r.Context())
+	if err != nil {
+		log.Printf("Failed to get last sync run: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to get sync status")
+		return
+	}
+
+	lastSuccess, err := s.db.GetLastSuccessfulSyncRun(r.Context())
+	if err != nil {
+		log.Printf("Failed to get last successful sync run: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to get sync status")
+		return
+	}
+
+	response := map[string]interface{}{
+		"running":   s.scheduler.running.Load(),
+		"nextRunAt": s.scheduler.getNextRunAt().Format(time.RFC3339),
+	}
+	if last != nil {
+		response["lastRun"] = last
+	}
+	if lastSuccess != nil {
+		response["lastSuccessfulRun"] = lastSuccess
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// sseWriteTimeout bounds how long a single SSE write is allowed to take
+// before it counts as a missed heartbeat for that client.
+const sseWriteTimeout = 5 * time.Second
+
+// sseMissedHeartbeatLimit is how many writes in a row can time out before a
+// slow or unresponsive /api/stream/balance client is dropped, so one stuck
+// client can never block the publisher indefinitely.
+const sseMissedHeartbeatLimit = 3
+
+// deadlineTimer races each SSE write against sseWriteTimeout and counts
+// consecutive misses, closing cancel once a client has missed too many
+// writes in a row. A write that completes in time resets the miss count.
+type deadlineTimer struct {
+	missed int
+	cancel chan struct{}
+}
+
+func newDeadlineTimer() *deadlineTimer {
+	return &deadlineTimer{cancel: make(chan struct{})}
+}
+
+// write runs fn with a deadline and returns false once the caller should
+// stop writing to this client (either fn failed or it has now missed
+// sseMissedHeartbeatLimit writes in a row).
+func (d *deadlineTimer) write(fn func() error) bool {
+	done := make(chan error, 1)
+	go func() { done <- fn() }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return false
+		}
+		d.missed = 0
+	case <-time.After(sseWriteTimeout):
+		d.missed++
+		if d.missed >= sseMissedHeartbeatLimit {
+			close(d.cancel)
+			return false
+		}
+	}
+	return true
+}
+
+// handleSSE subscribes the client to the server's event bus and streams
+// every published event as a JSON payload, so the frontend can render live
+// sync progress and balance changes without polling /portfolios or
+// /balance.
+func (s *server) handleSSE(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	clientID := uuid.New().String()
+	sub := s.events.Subscribe(clientID)
+	defer s.events.Unsubscribe(clientID)
+	log.Printf("SSE client connected: %s", clientID)
+	defer log.Printf("SSE client disconnected: %s", clientID)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "SSE not supported", http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, "event: connected\ndata: {\"clientId\":\"%s\"}\n\n", clientID)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(time.Duration(s.env.SSEHeartbeatSeconds) * time.Second)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-sub.Events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(event.Data)
+			if err != nil {
+				log.Printf("Failed to marshal SSE event %s: %v", event.Kind, err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Kind, data)
+			flusher.Flush()
+		case <-heartbeat.C:
+			fmt.Fprintf(w, ": heartbeat\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+func writeBalanceEvent(w http.ResponseWriter, flusher http.Flusher, id int64, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", id, payload); err != nil {
+		return err
+	}
+	flusher.Flush()
+	return nil
+}
+
+// handleBalanceStream upgrades to SSE and streams only the balance-relevant
+// events (a portfolio upsert or a new balance_history row) from syncPortfolios, so
+// a dashboard can watch live balances without the noise of /api/events. A
+// client reconnecting with Last-Event-ID is first replayed from
+// balance_history for everything it missed, then switched to live events. A
+// deadlineTimer drops the connection after sseMissedHeartbeatLimit writes in
+// a row time out, so one slow client can never block the publisher.
+func (s *server) handleBalanceStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "SSE not supported", http.StatusInternalServerError)
+		return
+	}
+
+	creds, err := s.db.GetCredentials(r.Context())
+	if err != nil || creds == nil {
+		writeError(w, http.StatusNotFound, "no credentials found")
+		return
+	}
+
+	var lastEventID int64
+	if idHeader := r.Header.Get("Last-Event-ID"); idHeader != "" {
+		if parsed, err := strconv.ParseInt(idHeader, 10, 64); err == nil {
+			lastEventID = parsed
+		}
+	}
+
+	clientID := uuid.New().String()
+	sub := s.events.Subscribe(clientID)
+	defer s.events.Unsubscribe(clientID)
+	log.Printf("Balance stream client connected: %s", clientID)
+	defer log.Printf("Balance stream client disconnected: %s", clientID)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+
+	deadline := newDeadlineTimer()
+
+	backlog, err := s.db.GetBalanceHistorySince(r.Context(), creds.ID, lastEventID)
+	if err != nil {
+		log.Printf("Failed to load balance history backlog for %s: %v", clientID, err)
+	}
+	for _, point := range backlog {
+		if !deadline.write(func() error { return writeBalanceEvent(w, flusher, point.ID, point) }) {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(time.Duration(s.env.SSEHeartbeatSeconds) * time.Second)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-deadline.cancel:
+			log.Printf("Dropping slow balance stream client %s after missed heartbeats", clientID)
+			return
+		case event, ok := <-sub.Events:
+			if !ok {
+				return
+			}
+			if event.Kind != EventPortfolioUpserted && event.Kind != EventBalanceRecorded {
+				continue
+			}
+			data := event.Data
+			id, _ := data.(map[string]interface{})["historyId"].(int64)
+			if !deadline.write(func() error { return writeBalanceEvent(w, flusher, id, data) }) {
+				return
+			}
+		case <-heartbeat.C:
+			if !deadline.write(func() error {
+				_, err := fmt.Fprint(w, ": heartbeat\n\n")
+				if err == nil {
+					flusher.Flush()
+				}
+				return err
+			}) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Webhook event kinds, matching the dot-separated naming used by the
+// renterd-style webhooks subsystem this was modeled on.
+const (
+	WebhookSyncCompleted             = "sync.completed"
+	WebhookSyncFailed                = "sync.failed"
+	WebhookPortfolioBalanceChanged   = "portfolio.balance_changed"
+	WebhookCredentialsCookieExpiring = "credentials.cookie_expiring"
+)
+
+var webhookRetryDelays = []time.Duration{
+	1 * time.Second,
+	5 * time.Second,
+	30 * time.Second,
+	2 * time.Minute,
+	10 * time.Minute,
+	1 * time.Hour,
+}
+
+type Webhook struct {
+	ID         int64     `json:"id"`
+	URL        string    `json:"url"`
+	Secret     string    `json:"-"`
+	EventKinds []string  `json:"eventKinds"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+type WebhookDelivery struct {
+	ID           int64      `json:"id"`
+	WebhookID    int64      `json:"webhookId"`
+	EventKind    string     `json:"eventKind"`
+	Attempt      int        `json:"attempt"`
+	Status       string     `json:"status"`
+	ResponseCode *int       `json:"responseCode,omitempty"`
+	LastError    *string    `json:"lastError,omitempty"`
+	CreatedAt    time.Time  `json:"createdAt"`
+	DeliveredAt  *time.Time `json:"deliveredAt,omitempty"`
+}
+
+func (db *DB) CreateWebhook(ctx context.Context, url, secret string, eventKinds []string) (*Webhook, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	var wh Webhook
+	err := db.Pool.QueryRow(ctx, `
+		INSERT INTO webhooks (url, secret, event_kinds)
+		VALUES ($1, $2, $3)
+		RETURNING id, url, secret, event_kinds, created_at
+	`, url, secret, eventKinds).Scan(&wh.ID, &wh.URL, &wh.Secret, &wh.EventKinds, &wh.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &wh, nil
+}
+
+func (db *DB) ListWebhooks(ctx context.Context) ([]Webhook, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.Pool.Query(ctx, `
+		SELECT id, url, secret, event_kinds, created_at FROM webhooks ORDER BY id ASC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var webhooks []Webhook
+	for rows.Next() {
+		var wh Webhook
+		if err := rows.Scan(&wh.ID, &wh.URL, &wh.Secret, &wh.EventKinds, &wh.CreatedAt); err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, wh)
+	}
+	return webhooks, rows.Err()
+}
+
+func (db *DB) GetWebhooksForEvent(ctx context.Context, kind string) ([]Webhook, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.Pool.Query(ctx, `
+		SELECT id, url, secret, event_kinds, created_at FROM webhooks WHERE $1 = ANY(event_kinds)
+	`, kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var webhooks []Webhook
+	for rows.Next() {
+		var wh Webhook
+		if err := rows.Scan(&wh.ID, &wh.URL, &wh.Secret, &wh.EventKinds, &wh.CreatedAt); err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, wh)
+	}
+	return webhooks, rows.Err()
+}
+
+func (db *DB) DeleteWebhook(ctx context.Context, id int64) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := db.Pool.Exec(ctx, `DELETE FROM webhooks WHERE id = $1`, id)
+	return err
+}
+
+func (db *DB) InsertWebhookDelivery(ctx context.Context, webhookID int64, kind string, payload []byte) (int64, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	var id int64
+	err := db.Pool.QueryRow(ctx, `
+		INSERT INTO webhook_deliveries (webhook_id, event_kind, payload)
+		VALUES ($1, $2, $3)
+		RETURNING id
+	`, webhookID, kind, payload).Scan(&id)
+	return id, err
+}
+
+func (db *DB) RecordDeliveryAttempt(ctx context.Context, deliveryID int64, attempt int, status string, responseCode *int, lastError *string) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	var deliveredAt *time.Time
+	if status == "delivered" {
+		now := time.Now().UTC()
+		deliveredAt = &now
+	}
+
+	_, err := db.Pool.Exec(ctx, `
+		UPDATE webhook_deliveries
+		SET attempt = $2, status = $3, response_code = $4, last_error = $5, delivered_at = $6
+		WHERE id = $1
+	`, deliveryID, attempt, status, responseCode, lastError, deliveredAt)
+	return err
+}
+
+func (db *DB) ListDeliveries(ctx context.Context, webhookID int64) ([]WebhookDelivery, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.Pool.Query(ctx, `
+		SELECT id, webhook_id, event_kind, attempt, status, response_code, last_error, created_at, delivered_at
+		FROM webhook_deliveries
+		WHERE webhook_id = $1
+		ORDER BY created_at DESC
+	`, webhookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.EventKind, &d.Attempt, &d.Status, &d.ResponseCode, &d.LastError, &d.CreatedAt, &d.DeliveredAt); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+func signPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// notifyWebhooks looks up subscribers for kind and delivers to each in its own
+// goroutine, mirroring the fire-and-forget style of syncPortfolios.
+func (s *server) notifyWebhooks(kind string, payload map[string]interface{}) {
+	ctx := context.Background()
+
+	hooks, err := s.db.GetWebhooksForEvent(ctx, kind)
+	if err != nil {
+		log.Printf("failed to look up webhooks for %s: %v", kind, err)
+		return
+	}
+	if len(hooks) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"event":     kind,
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+		"data":      payload,
+	})
+	if err != nil {
+		log.Printf("failed to marshal webhook payload: %v", err)
+		return
+	}
+
+	for _, hook := range hooks {
+		deliveryID, err := s.db.InsertWebhookDelivery(ctx, hook.ID, kind, body)
+		if err != nil {
+			log.Printf("failed to record delivery for webhook %d: %v", hook.ID, err)
+			continue
+		}
+		go s.deliverWebhook(hook, deliveryID, body)
+	}
+}
+
+func (s *server) deliverWebhook(hook Webhook, deliveryID int64, body []byte) {
+	ctx := context.Background()
+	client := &http.Client{Timeout: 5 * time.Second}
+	signature := "sha256=" + signPayload(hook.Secret, body)
+
+	var lastErr error
+	var lastCode *int
+
+	for attempt := 0; attempt <= len(webhookRetryDelays); attempt++ {
+		req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+		if err != nil {
+			lastErr = err
+			break
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Signature", signature)
+
+		resp, err := client.Do(req)
+		if err == nil {
+			code := resp.StatusCode
+			resp.Body.Close()
+			lastCode = &code
+			if code >= 200 && code < 300 {
+				_ = s.db.RecordDeliveryAttempt(ctx, deliveryID, attempt+1, "delivered", lastCode, nil)
+				return
+			}
+			lastErr = fmt.Errorf("unexpected status %d", code)
+		} else {
+			lastErr = err
+		}
+
+		errMsg := lastErr.Error()
+		status := "retrying"
+		if attempt == len(webhookRetryDelays) {
+			status = "failed"
+		}
+		_ = s.db.RecordDeliveryAttempt(ctx, deliveryID, attempt+1, status, lastCode, &errMsg)
+
+		if attempt < len(webhookRetryDelays) {
+			time.Sleep(webhookRetryDelays[attempt])
+		}
+	}
+}
+
+type createWebhookRequest struct {
+	URL        string   `json:"url"`
+	Secret     string   `json:"secret"`
+	EventKinds []string `json:"eventKinds"`
+}
+
+func (s *server) handleCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var req createWebhookRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.URL == "" || req.Secret == "" || len(req.EventKinds) == 0 {
+		writeError(w, http.StatusBadRequest, "url, secret and eventKinds are required")
+		return
+	}
+
+	wh, err := s.db.CreateWebhook(r.Context(), req.URL, req.Secret, req.EventKinds)
+	if err != nil {
+		log.Printf("failed to create webhook: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to create webhook")
+		return
+	}
+	writeJSON(w, http.StatusOK, wh)
+}
+
+func (s *server) handleListWebhooks(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := s.db.ListWebhooks(r.Context())
+	if err != nil {
+		log.Printf("failed to list webhooks: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to list webhooks")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"webhooks": webhooks})
+}
+
+func (s *server) handleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid webhook id")
+		return
+	}
+	if err := s.db.DeleteWebhook(r.Context(), id); err != nil {
+		log.Printf("failed to delete webhook: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to delete webhook")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (s *server) handleListWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid webhook id")
+		return
+	}
+	deliveries, err := s.db.ListDeliveries(r.Context(), id)
+	if err != nil {
+		log.Printf("failed to list deliveries: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to list deliveries")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"deliveries": deliveries})
+}
@@ -4,10 +4,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
-	"os"
-	"path/filepath"
-	"sort"
 	"strings"
 	"time"
 
@@ -38,96 +34,17 @@ func (db *DB) Close() {
 	db.Pool.Close()
 }
 
-func (db *DB) applyMigrations(ctx context.Context, migrationsPath string) error {
-	entries, err := os.ReadDir(migrationsPath)
-	if err != nil {
-		return fmt.Errorf("read migrations: %w", err)
-	}
-
-	migrationFiles := make([]string, 0, len(entries))
-	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
-		}
-		if strings.HasSuffix(entry.Name(), ".sql") {
-			migrationFiles = append(migrationFiles, entry.Name())
-		}
-	}
-	sort.Strings(migrationFiles)
-
-	if len(migrationFiles) == 0 {
-		return errors.New("no migration files found")
-	}
-
-	_, err = db.Pool.Exec(ctx, `
-		CREATE TABLE IF NOT EXISTS _migrations (
-			name TEXT PRIMARY KEY,
-			applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
-		);
-	`)
-	if err != nil {
-		return fmt.Errorf("create _migrations: %w", err)
-	}
-
-	for _, fileName := range migrationFiles {
-		if err := db.applyMigrationFile(ctx, migrationsPath, fileName); err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
-func (db *DB) applyMigrationFile(ctx context.Context, migrationsPath, fileName string) error {
-	var exists bool
-	err := db.Pool.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM _migrations WHERE name=$1)`, fileName).Scan(&exists)
-	if err != nil {
-		return fmt.Errorf("check migration %s: %w", fileName, err)
-	}
-	if exists {
-		return nil
-	}
-
-	path := filepath.Join(migrationsPath, fileName)
-	sqlBytes, err := os.ReadFile(path)
-	if err != nil {
-		return fmt.Errorf("read migration %s: %w", fileName, err)
-	}
-
-	tx, err := db.Pool.Begin(ctx)
-	if err != nil {
-		return fmt.Errorf("begin migration %s: %w", fileName, err)
-	}
-
-	if _, err := tx.Exec(ctx, string(sqlBytes)); err != nil {
-		_ = tx.Rollback(ctx)
-		return fmt.Errorf("exec migration %s: %w", fileName, err)
-	}
-
-	if _, err := tx.Exec(ctx, `INSERT INTO _migrations (name) VALUES ($1)`, fileName); err != nil {
-		_ = tx.Rollback(ctx)
-		return fmt.Errorf("record migration %s: %w", fileName, err)
-	}
-
-	if err := tx.Commit(ctx); err != nil {
-		return fmt.Errorf("commit migration %s: %w", fileName, err)
-	}
-
-	log.Printf("Applied migration %s", fileName)
-	return nil
-}
-
 func (db *DB) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
 	return context.WithTimeout(ctx, 10*time.Second)
 }
 
 type Wallet struct {
-	ID             int64     `json:"id"`
-	Address        string    `json:"address"`
-	AssetClass     string    `json:"assetClass"`
-	Label          *string   `json:"label,omitempty"`
-	CreatedAt      time.Time `json:"createdAt"`
-	LatestPriceUSD *float64  `json:"latestPriceUsd,omitempty"`
+	ID             int64      `json:"id"`
+	Address        string     `json:"address"`
+	AssetClass     string     `json:"assetClass"`
+	Label          *string    `json:"label,omitempty"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	LatestPriceUSD *float64   `json:"latestPriceUsd,omitempty"`
 	LatestAt       *time.Time `json:"latestAt,omitempty"`
 }
 
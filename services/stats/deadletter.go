@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type deadLetterPrice struct {
+	ID        int64     `json:"id"`
+	Payload   []byte    `json:"-"`
+	LastError string    `json:"lastError"`
+	FailedAt  time.Time `json:"failedAt"`
+}
+
+func (db *DB) InsertDeadLetterPrice(ctx context.Context, payload []byte, lastError string) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := db.Pool.Exec(ctx, `
+		INSERT INTO dead_letter_prices (payload, last_error)
+		VALUES ($1, $2)
+	`, payload, lastError)
+	return err
+}
+
+func (db *DB) ListDeadLetterPrices(ctx context.Context) ([]deadLetterPrice, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.Pool.Query(ctx, `
+		SELECT id, payload, last_error, failed_at FROM dead_letter_prices ORDER BY id ASC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []deadLetterPrice
+	for rows.Next() {
+		var item deadLetterPrice
+		if err := rows.Scan(&item.ID, &item.Payload, &item.LastError, &item.FailedAt); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+func (db *DB) GetDeadLetterPrice(ctx context.Context, id int64) (*deadLetterPrice, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	var item deadLetterPrice
+	err := db.Pool.QueryRow(ctx, `
+		SELECT id, payload, last_error, failed_at FROM dead_letter_prices WHERE id = $1
+	`, id).Scan(&item.ID, &item.Payload, &item.LastError, &item.FailedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+func (db *DB) DeleteDeadLetterPrice(ctx context.Context, id int64) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := db.Pool.Exec(ctx, `DELETE FROM dead_letter_prices WHERE id = $1`, id)
+	return err
+}
+
+func (s *server) handleListDeadLetterPrices(w http.ResponseWriter, r *http.Request) {
+	items, err := s.db.ListDeadLetterPrices(r.Context())
+	if err != nil {
+		log.Printf("failed to list dead-letter prices: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to list dead-letter prices")
+		return
+	}
+
+	out := make([]map[string]interface{}, 0, len(items))
+	for _, item := range items {
+		var payload priceIngest
+		_ = json.Unmarshal(item.Payload, &payload)
+		out = append(out, map[string]interface{}{
+			"id":        item.ID,
+			"payload":   payload,
+			"lastError": item.LastError,
+			"failedAt":  item.FailedAt,
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"items": out})
+}
+
+func (s *server) handleRetryDeadLetterPrice(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid dead-letter id")
+		return
+	}
+
+	item, err := s.db.GetDeadLetterPrice(r.Context(), id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "dead-letter item not found")
+		return
+	}
+
+	var payload priceIngest
+	if err := json.Unmarshal(item.Payload, &payload); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to decode dead-letter payload")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(s.env.IngestEnqueueMS)*time.Millisecond)
+	defer cancel()
+
+	select {
+	case s.ingestCh <- payload:
+		if err := s.db.DeleteDeadLetterPrice(r.Context(), id); err != nil {
+			log.Printf("failed to delete dead-letter item %d after re-enqueue: %v", id, err)
+		}
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "requeued"})
+	case <-ctx.Done():
+		writeError(w, http.StatusTooManyRequests, "ingest queue full")
+	}
+}
@@ -14,6 +14,10 @@ type Env struct {
 	IngestBufferSize    int
 	IngestWorkers       int
 	SSEHeartbeatSeconds int
+	IngestRetryBaseMS   int
+	IngestRetryFactor   int
+	IngestMaxAttempts   int
+	IngestEnqueueMS     int
 }
 
 func loadEnv() Env {
@@ -28,10 +32,14 @@ func loadEnv() Env {
 		Port:                os.Getenv("PORT"),
 		DatabaseURL:         os.Getenv("DATABASE_URL"),
 		NodeEnv:             getEnvDefault("NODE_ENV", "development"),
-		MigrationsPath:      getEnvDefault("MIGRATIONS_PATH", "migrations"),
+		MigrationsPath:      getEnvDefault("MIGRATIONS_PATH", ""),
 		IngestBufferSize:    getEnvDefaultInt("STATS_INGEST_BUFFER", 1000),
 		IngestWorkers:       getEnvDefaultInt("STATS_INGEST_WORKERS", 2),
 		SSEHeartbeatSeconds: getEnvDefaultInt("SSE_HEARTBEAT_SECONDS", 15),
+		IngestRetryBaseMS:   getEnvDefaultInt("STATS_INGEST_RETRY_BASE_MS", 500),
+		IngestRetryFactor:   getEnvDefaultInt("STATS_INGEST_RETRY_FACTOR", 2),
+		IngestMaxAttempts:   getEnvDefaultInt("STATS_INGEST_MAX_ATTEMPTS", 5),
+		IngestEnqueueMS:     getEnvDefaultInt("STATS_INGEST_ENQUEUE_TIMEOUT_MS", 200),
 	}
 }
 
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
@@ -28,17 +29,24 @@ type sseClient struct {
 }
 
 type server struct {
-	env        Env
-	db         *DB
-	ingestCh   chan priceIngest
-	sseClients map[string]*sseClient
-	sseMutex   sync.RWMutex
+	env          Env
+	db           *DB
+	ingestCh     chan priceIngest
+	webhookCh    chan webhookEvent
+	sseClients   map[string]*sseClient
+	sseMutex     sync.RWMutex
+	workerHealth sync.Map // worker id -> unix timestamp of last processed item
 }
 
 func main() {
 	env := loadEnv()
 	ctx := context.Background()
 
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrateCLI(env, os.Args[2:])
+		return
+	}
+
 	db, err := initDB(ctx, env)
 	if err != nil {
 		log.Fatalf("Failed to init DB: %v", err)
@@ -49,17 +57,17 @@ func main() {
 		env:        env,
 		db:         db,
 		ingestCh:   make(chan priceIngest, env.IngestBufferSize),
+		webhookCh:  make(chan webhookEvent, env.IngestBufferSize),
 		sseClients: make(map[string]*sseClient),
 	}
 	s.startWorkers()
+	s.startWebhookWorkers()
 
 	router := chi.NewRouter()
 	router.Use(s.corsMiddleware)
 	router.Use(s.loggingMiddleware)
 
-	router.Get("/health", func(w http.ResponseWriter, r *http.Request) {
-		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
-	})
+	router.Get("/health", s.handleHealth)
 
 	router.Route("/api", func(r chi.Router) {
 		r.Get("/wallets", s.handleListWallets)
@@ -68,6 +76,12 @@ func main() {
 		r.Get("/wallets/{id}/history", s.handleWalletHistory)
 		r.Get("/history", s.handleAggregateHistory)
 		r.Get("/events", s.handleSSE)
+		r.Post("/webhooks", s.handleCreateWebhook)
+		r.Get("/webhooks", s.handleListWebhooks)
+		r.Delete("/webhooks/{id}", s.handleDeleteWebhook)
+		r.Get("/webhooks/{id}/deliveries", s.handleListWebhookDeliveries)
+		r.Get("/prices/dead-letter", s.handleListDeadLetterPrices)
+		r.Post("/prices/dead-letter/{id}/retry", s.handleRetryDeadLetterPrice)
 	})
 
 	addr := ":" + env.Port
@@ -77,20 +91,70 @@ func main() {
 	}
 }
 
+func (s *server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	now := time.Now().Unix()
+	workers := make(map[string]int64)
+	s.workerHealth.Range(func(key, value interface{}) bool {
+		workerID := key.(int64)
+		lastSeen := value.(int64)
+		workers[strconv.FormatInt(workerID, 10)] = now - lastSeen
+		return true
+	})
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":              "ok",
+		"ingestQueueDepth":    len(s.ingestCh),
+		"ingestQueueCapacity": cap(s.ingestCh),
+		"workersIdleSeconds":  workers,
+	})
+}
+
 func (s *server) startWorkers() {
 	for i := 0; i < s.env.IngestWorkers; i++ {
 		go func(workerID int) {
+			s.workerHealth.Store(int64(workerID), time.Now().Unix())
 			for item := range s.ingestCh {
-				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-				if err := s.db.InsertPrice(ctx, item.WalletID, item.PriceUSD, item.RecordedAt); err != nil {
-					log.Printf("Worker %d failed to insert price: %v", workerID, err)
-				}
-				cancel()
+				s.processIngestItem(workerID, item)
+				s.workerHealth.Store(int64(workerID), time.Now().Unix())
 			}
 		}(i + 1)
 	}
 }
 
+// processIngestItem retries InsertPrice with exponential backoff, falling back
+// to dead_letter_prices so a DB blip never silently drops the item.
+func (s *server) processIngestItem(workerID int, item priceIngest) {
+	delay := time.Duration(s.env.IngestRetryBaseMS) * time.Millisecond
+	var lastErr error
+
+	for attempt := 1; attempt <= s.env.IngestMaxAttempts; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := s.db.InsertPrice(ctx, item.WalletID, item.PriceUSD, item.RecordedAt)
+		cancel()
+		if err == nil {
+			return
+		}
+
+		lastErr = err
+		log.Printf("Worker %d failed to insert price (attempt %d/%d): %v", workerID, attempt, s.env.IngestMaxAttempts, err)
+		if attempt < s.env.IngestMaxAttempts {
+			time.Sleep(delay)
+			delay *= time.Duration(s.env.IngestRetryFactor)
+		}
+	}
+
+	payload, err := json.Marshal(item)
+	if err != nil {
+		log.Printf("Worker %d failed to marshal dead-letter payload: %v", workerID, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.db.InsertDeadLetterPrice(ctx, payload, lastErr.Error()); err != nil {
+		log.Printf("Worker %d failed to persist dead-letter price: %v", workerID, err)
+	}
+}
+
 func (s *server) handleListWallets(w http.ResponseWriter, r *http.Request) {
 	wallets, err := s.db.ListWallets(r.Context())
 	if err != nil {
@@ -127,10 +191,10 @@ func (s *server) handleCreateWallet(w http.ResponseWriter, r *http.Request) {
 }
 
 type ingestPriceRequest struct {
-	WalletID     *int64  `json:"walletId"`
-	WalletAddress *string `json:"walletAddress"`
-	PriceUSD     *float64 `json:"priceUsd"`
-	RecordedAt   *string `json:"recordedAt"`
+	WalletID      *int64   `json:"walletId"`
+	WalletAddress *string  `json:"walletAddress"`
+	PriceUSD      *float64 `json:"priceUsd"`
+	RecordedAt    *string  `json:"recordedAt"`
 }
 
 func (s *server) handleIngestPrice(w http.ResponseWriter, r *http.Request) {
@@ -179,12 +243,20 @@ func (s *server) handleIngestPrice(w http.ResponseWriter, r *http.Request) {
 		RecordedAt: recordedAt,
 	}
 
+	enqueueCtx, cancel := context.WithTimeout(r.Context(), time.Duration(s.env.IngestEnqueueMS)*time.Millisecond)
+	defer cancel()
+
 	select {
 	case s.ingestCh <- item:
 		// Broadcast to SSE clients
 		s.broadcastPriceUpdate(walletID, *req.PriceUSD, recordedAt)
+		s.enqueueWebhookEvent("price_update", map[string]interface{}{
+			"walletId":   walletID,
+			"priceUsd":   *req.PriceUSD,
+			"recordedAt": recordedAt.Format(time.RFC3339),
+		})
 		writeJSON(w, http.StatusAccepted, map[string]string{"status": "queued"})
-	default:
+	case <-enqueueCtx.Done():
 		writeError(w, http.StatusTooManyRequests, "ingest queue full")
 	}
 }
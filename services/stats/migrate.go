@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// embeddedMigrations carries the service's own schema inside the binary, so
+// a deploy is just the binary — no migrations directory needs to ship
+// alongside it. MIGRATIONS_PATH, when set, overrides this with a directory
+// on disk, which is handy while iterating on a new migration locally.
+//
+//go:embed migrations/*.sql
+var embeddedMigrations embed.FS
+
+var migrationFileNameRe = regexp.MustCompile(`^(\d+)_(.+)\.sql$`)
+
+type parsedMigration struct {
+	Version  int64
+	Name     string
+	FileName string
+	UpSQL    string
+	DownSQL  string
+	Checksum string
+}
+
+// splitMigration pulls the "-- +up" / "-- +down" sections out of a migration
+// file, following the directive convention used by tools like rockhopper.
+func splitMigration(content []byte) (up, down string, err error) {
+	text := string(content)
+	upIdx := strings.Index(text, "-- +up")
+	downIdx := strings.Index(text, "-- +down")
+	if upIdx == -1 || downIdx == -1 {
+		return "", "", errors.New("migration missing -- +up / -- +down markers")
+	}
+	if downIdx < upIdx {
+		return "", "", errors.New("-- +down must follow -- +up")
+	}
+
+	up = strings.TrimSpace(text[upIdx+len("-- +up") : downIdx])
+	down = strings.TrimSpace(text[downIdx+len("-- +down"):])
+	return up, down, nil
+}
+
+// migrationsFS resolves the filesystem migrations are read from: the
+// embedded copy by default, or a directory on disk when MIGRATIONS_PATH is
+// set.
+func migrationsFS(overridePath string) (fs.FS, error) {
+	if overridePath == "" {
+		sub, err := fs.Sub(embeddedMigrations, "migrations")
+		if err != nil {
+			return nil, fmt.Errorf("load embedded migrations: %w", err)
+		}
+		return sub, nil
+	}
+	return os.DirFS(overridePath), nil
+}
+
+func loadMigrationFile(migFS fs.FS, fileName string) (*parsedMigration, error) {
+	match := migrationFileNameRe.FindStringSubmatch(fileName)
+	if match == nil {
+		return nil, fmt.Errorf("migration filename %q must look like <version>_<name>.sql", fileName)
+	}
+	version, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid version in %q: %w", fileName, err)
+	}
+
+	raw, err := fs.ReadFile(migFS, fileName)
+	if err != nil {
+		return nil, fmt.Errorf("read migration %s: %w", fileName, err)
+	}
+
+	up, down, err := splitMigration(raw)
+	if err != nil {
+		return nil, fmt.Errorf("parse migration %s: %w", fileName, err)
+	}
+
+	sum := sha256.Sum256(raw)
+
+	return &parsedMigration{
+		Version:  version,
+		Name:     match[2],
+		FileName: fileName,
+		UpSQL:    up,
+		DownSQL:  down,
+		Checksum: hex.EncodeToString(sum[:]),
+	}, nil
+}
+
+func loadMigrations(migrationsPath string) ([]*parsedMigration, error) {
+	migFS, err := migrationsFS(migrationsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := fs.ReadDir(migFS, ".")
+	if err != nil {
+		return nil, fmt.Errorf("read migrations: %w", err)
+	}
+
+	var migrations []*parsedMigration
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".sql") {
+			continue
+		}
+		m, err := loadMigrationFile(migFS, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// migrationAdvisoryLockKey is an arbitrary constant that applyMigrations (the
+// automatic run at startup) locks on, so two pods starting at once serialize
+// on it instead of racing to apply the same version twice. The migrate CLI
+// subcommands do not take this lock.
+const migrationAdvisoryLockKey = 72176_01
+
+func (db *DB) applyMigrations(ctx context.Context, migrationsPath string) error {
+	migrations, err := loadMigrations(migrationsPath)
+	if err != nil {
+		return err
+	}
+	if len(migrations) == 0 {
+		return errors.New("no migration files found")
+	}
+
+	if _, err := db.Pool.Exec(ctx, `SELECT pg_advisory_lock($1)`, int64(migrationAdvisoryLockKey)); err != nil {
+		return fmt.Errorf("acquire migration lock: %w", err)
+	}
+	defer db.Pool.Exec(ctx, `SELECT pg_advisory_unlock($1)`, int64(migrationAdvisoryLockKey))
+
+	if _, err := db.Pool.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS _migrations (
+			version BIGINT PRIMARY KEY,
+			name TEXT NOT NULL,
+			checksum TEXT NOT NULL,
+			down_sql TEXT NOT NULL DEFAULT '',
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+	`); err != nil {
+		return fmt.Errorf("create _migrations: %w", err)
+	}
+	if _, err := db.Pool.Exec(ctx, `ALTER TABLE _migrations ADD COLUMN IF NOT EXISTS down_sql TEXT NOT NULL DEFAULT ''`); err != nil {
+		return fmt.Errorf("add down_sql to _migrations: %w", err)
+	}
+
+	for _, m := range migrations {
+		if err := db.applyMigration(ctx, m); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (db *DB) applyMigration(ctx context.Context, m *parsedMigration) error {
+	var existingChecksum string
+	err := db.Pool.QueryRow(ctx, `SELECT checksum FROM _migrations WHERE version = $1`, m.Version).Scan(&existingChecksum)
+	if err == nil {
+		if existingChecksum != m.Checksum {
+			return fmt.Errorf("migration %s was modified after being applied (checksum mismatch)", m.FileName)
+		}
+		return nil
+	}
+
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("begin migration %s: %w", m.FileName, err)
+	}
+
+	if _, err := tx.Exec(ctx, m.UpSQL); err != nil {
+		_ = tx.Rollback(ctx)
+		return fmt.Errorf("exec migration %s: %w", m.FileName, err)
+	}
+
+	if _, err := tx.Exec(ctx, `
+		INSERT INTO _migrations (version, name, checksum, down_sql) VALUES ($1, $2, $3, $4)
+	`, m.Version, m.Name, m.Checksum, m.DownSQL); err != nil {
+		_ = tx.Rollback(ctx)
+		return fmt.Errorf("record migration %s: %w", m.FileName, err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("commit migration %s: %w", m.FileName, err)
+	}
+
+	log.Printf("Applied migration %s", m.FileName)
+	return nil
+}
+
+type migrationStatus struct {
+	Version   int64
+	Name      string
+	Applied   bool
+	AppliedAt string
+}
+
+func (db *DB) migrationStatus(ctx context.Context, migrationsPath string) ([]migrationStatus, error) {
+	migrations, err := loadMigrations(migrationsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Pool.Query(ctx, `SELECT version, applied_at FROM _migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int64]string)
+	for rows.Next() {
+		var version int64
+		var appliedAt string
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+
+	var statuses []migrationStatus
+	for _, m := range migrations {
+		appliedAt, ok := applied[m.Version]
+		statuses = append(statuses, migrationStatus{Version: m.Version, Name: m.Name, Applied: ok, AppliedAt: appliedAt})
+	}
+	return statuses, rows.Err()
+}
+
+func (db *DB) migrateUpTo(ctx context.Context, migrationsPath string, toVersion int64) error {
+	migrations, err := loadMigrations(migrationsPath)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if toVersion > 0 && m.Version > toVersion {
+			break
+		}
+		if err := db.applyMigration(ctx, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *DB) migrateDownTo(ctx context.Context, migrationsPath string, toVersion int64) error {
+	migrations, err := loadMigrations(migrationsPath)
+	if err != nil {
+		return err
+	}
+
+	byVersion := make(map[int64]*parsedMigration, len(migrations))
+	for _, m := range migrations {
+		byVersion[m.Version] = m
+	}
+
+	rows, err := db.Pool.Query(ctx, `SELECT version FROM _migrations WHERE version > $1 ORDER BY version DESC`, toVersion)
+	if err != nil {
+		return err
+	}
+	var toRevert []int64
+	for rows.Next() {
+		var version int64
+		if err := rows.Scan(&version); err != nil {
+			rows.Close()
+			return err
+		}
+		toRevert = append(toRevert, version)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, version := range toRevert {
+		m, ok := byVersion[version]
+		if !ok {
+			return fmt.Errorf("cannot roll back version %d: migration file no longer present", version)
+		}
+
+		tx, err := db.Pool.Begin(ctx)
+		if err != nil {
+			return fmt.Errorf("begin rollback of %s: %w", m.FileName, err)
+		}
+		if _, err := tx.Exec(ctx, m.DownSQL); err != nil {
+			_ = tx.Rollback(ctx)
+			return fmt.Errorf("exec down migration %s: %w", m.FileName, err)
+		}
+		if _, err := tx.Exec(ctx, `DELETE FROM _migrations WHERE version = $1`, version); err != nil {
+			_ = tx.Rollback(ctx)
+			return fmt.Errorf("unrecord migration %s: %w", m.FileName, err)
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return fmt.Errorf("commit rollback of %s: %w", m.FileName, err)
+		}
+		log.Printf("Reverted migration %s", m.FileName)
+	}
+
+	return nil
+}
+
+// Rollback reverts the last `steps` applied migrations using the down SQL
+// stored in _migrations at apply time, rather than re-reading migration
+// files off disk. This is what makes `migrate down <n>` safe to run against
+// an older binary image that may not carry the original migration anymore.
+func (db *DB) Rollback(ctx context.Context, steps int) error {
+	if steps <= 0 {
+		return fmt.Errorf("steps must be positive, got %d", steps)
+	}
+
+	rows, err := db.Pool.Query(ctx, `
+		SELECT version, name, down_sql FROM _migrations ORDER BY version DESC LIMIT $1
+	`, steps)
+	if err != nil {
+		return err
+	}
+
+	type appliedMigration struct {
+		Version int64
+		Name    string
+		DownSQL string
+	}
+	var toRevert []appliedMigration
+	for rows.Next() {
+		var m appliedMigration
+		if err := rows.Scan(&m.Version, &m.Name, &m.DownSQL); err != nil {
+			rows.Close()
+			return err
+		}
+		toRevert = append(toRevert, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, m := range toRevert {
+		if strings.TrimSpace(m.DownSQL) == "" {
+			return fmt.Errorf("migration %d (%s) has no stored down block to roll back", m.Version, m.Name)
+		}
+
+		tx, err := db.Pool.Begin(ctx)
+		if err != nil {
+			return fmt.Errorf("begin rollback of %s: %w", m.Name, err)
+		}
+		if _, err := tx.Exec(ctx, m.DownSQL); err != nil {
+			_ = tx.Rollback(ctx)
+			return fmt.Errorf("exec down migration %s: %w", m.Name, err)
+		}
+		if _, err := tx.Exec(ctx, `DELETE FROM _migrations WHERE version = $1`, m.Version); err != nil {
+			_ = tx.Rollback(ctx)
+			return fmt.Errorf("unrecord migration %s: %w", m.Name, err)
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return fmt.Errorf("commit rollback of %s: %w", m.Name, err)
+		}
+		log.Printf("Rolled back migration %d (%s)", m.Version, m.Name)
+	}
+
+	return nil
+}
+
+// runMigrateCLI implements `<binary> migrate up|up-to <v>|down [steps]|down-to <v>|status`,
+// reusing the same DB code paths as the HTTP server's automatic migration run.
+func runMigrateCLI(env Env, args []string) {
+	if len(args) == 0 {
+		log.Fatal("usage: migrate <up|up-to|down|down-to|status> [version]")
+	}
+
+	ctx := context.Background()
+	pool, err := newMigrationPool(ctx, env.DatabaseURL)
+	if err != nil {
+		log.Fatalf("failed to connect: %v", err)
+	}
+	defer pool.Close()
+	db := &DB{Pool: pool}
+
+	switch args[0] {
+	case "up":
+		if err := db.migrateUpTo(ctx, env.MigrationsPath, 0); err != nil {
+			log.Fatalf("migrate up failed: %v", err)
+		}
+	case "up-to":
+		version := requireVersionArg(args)
+		if err := db.migrateUpTo(ctx, env.MigrationsPath, version); err != nil {
+			log.Fatalf("migrate up-to failed: %v", err)
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			parsed, err := strconv.Atoi(args[1])
+			if err != nil {
+				log.Fatalf("invalid step count %q: %v", args[1], err)
+			}
+			steps = parsed
+		}
+		if err := db.Rollback(ctx, steps); err != nil {
+			log.Fatalf("migrate down failed: %v", err)
+		}
+	case "down-to":
+		version := requireVersionArg(args)
+		if err := db.migrateDownTo(ctx, env.MigrationsPath, version); err != nil {
+			log.Fatalf("migrate down-to failed: %v", err)
+		}
+	case "status":
+		statuses, err := db.migrationStatus(ctx, env.MigrationsPath)
+		if err != nil {
+			log.Fatalf("migrate status failed: %v", err)
+		}
+		for _, st := range statuses {
+			state := "pending"
+			if st.Applied {
+				state = "applied at " + st.AppliedAt
+			}
+			fmt.Printf("%d\t%s\t%s\n", st.Version, st.Name, state)
+		}
+	default:
+		log.Fatalf("unknown migrate subcommand %q", args[0])
+	}
+}
+
+func requireVersionArg(args []string) int64 {
+	if len(args) < 2 {
+		log.Fatal("expected a version argument")
+	}
+	version, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		log.Fatalf("invalid version %q: %v", args[1], err)
+	}
+	return version
+}
+
+func newMigrationPool(ctx context.Context, databaseURL string) (*pgxpool.Pool, error) {
+	return pgxpool.New(ctx, databaseURL)
+}